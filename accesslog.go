@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/**
+ * Access log settings (see main). The log is off when accessLogPath is empty.
+ */
+var (
+	accessLogPath     string
+	accessLogFormat   = "combined"
+	accessLogMaxBytes int64
+	accessLogMaxAge   time.Duration
+)
+
+/**
+ * An access log file that writes one line per request, either in the Combined Log
+ * Format (with the duration and cache status appended) or as JSON. The file is rotated
+ * once it grows past maxBytes or gets older than maxAge (0 turns either one off), and
+ * it can be reopened (e.g. on SIGHUP after logrotate moved it).
+ */
+type accessLog struct {
+	mutex    sync.Mutex
+	path     string
+	format   string
+	maxBytes int64
+	maxAge   time.Duration
+	file     *os.File
+	size     int64
+	opened   time.Time
+}
+
+type accessEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int       `json:"bytes"`
+	Duration   float64   `json:"duration_seconds"`
+	Cache      string    `json:"cache"`
+	Referer    string    `json:"referer"`
+	UserAgent  string    `json:"user_agent"`
+}
+
+func newAccessLog(path, format string, maxBytes int64, maxAge time.Duration) (*accessLog, error) {
+	if format != "combined" && format != "json" {
+		return nil, fmt.Errorf("unknown access log format '%s' (expected combined or json)", format)
+	}
+	l := &accessLog{path: path, format: format, maxBytes: maxBytes, maxAge: maxAge}
+	if err := l.swap(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+/**
+ * Opens (or creates) the log path for appending and swaps it in for the current file,
+ * which is closed. If the open fails, the current file is kept. The caller must hold
+ * the mutex.
+ */
+func (l *accessLog) swap() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	if l.file != nil {
+		_ = l.file.Close()
+	}
+	l.file = file
+	l.size = info.Size()
+	l.opened = time.Now()
+	return nil
+}
+
+/**
+ * Opens the log path again, in place of the current file.
+ */
+func (l *accessLog) Reopen() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.swap()
+}
+
+/**
+ * Moves the current file aside (path.<timestamp>) and starts a new one. The caller
+ * must hold the mutex.
+ */
+func (l *accessLog) rotate() error {
+	rotated := l.path + "." + time.Now().Format("20060102-150405.000000000")
+	if err := os.Rename(l.path, rotated); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return l.swap()
+}
+
+func (l *accessLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Close()
+}
+
+func (l *accessLog) log(entry *accessEntry) {
+	var line []byte
+	if l.format == "json" {
+		line, _ = json.Marshal(entry)
+		line = append(line, '\n')
+	} else {
+		line = []byte(formatCombined(entry))
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if (l.maxBytes > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxBytes) ||
+		(l.maxAge > 0 && time.Now().Sub(l.opened) >= l.maxAge) {
+		if err := l.rotate(); err != nil {
+			log.Printf("Could not rotate the access log: %v", err)
+			// The lines keep going to the current file, it is tried again after another
+			// maxBytes or maxAge.
+			l.size = 0
+			l.opened = time.Now()
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		debugLog(fmt.Sprintf("Could not write to the access log: %v", err))
+	}
+}
+
+/**
+ * host ident authuser [date] "request" status bytes "referer" "user-agent" duration cache
+ */
+func formatCombined(entry *accessEntry) string {
+	bytesSent := "-"
+	if entry.Bytes > 0 {
+		bytesSent = strconv.Itoa(entry.Bytes)
+	}
+	return fmt.Sprintf("%s - - [%s] %s %d %s %s %s %s %s\n",
+		clfField(entry.RemoteAddr), entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(entry.Method+" "+entry.URI+" "+entry.Proto), entry.Status, bytesSent,
+		clfQuote(entry.Referer), clfQuote(entry.UserAgent),
+		strconv.FormatFloat(entry.Duration, 'f', 6, 64), clfField(entry.Cache))
+}
+
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func clfQuote(s string) string {
+	return strconv.Quote(clfField(s))
+}
+
+/**
+ * Wraps a handler so every request it serves gets written to the access log.
+ */
+func withAccessLog(l *accessLog, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		recorder := recordResponse(w)
+		// Deferred, so the responses cut off with a panic (e.g. http.ErrAbortHandler when
+		// the client went away mid-stream) are logged too.
+		defer func() {
+			aborted := recover()
+			status := recorder.statusCode()
+			if aborted != nil && recorder.status == 0 {
+				status = statusClientClosedRequest // Nothing was sent.
+			}
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			l.log(&accessEntry{startTime, host, r.Method, r.URL.RequestURI(), r.Proto,
+				status, recorder.bytes, time.Now().Sub(startTime).Seconds(),
+				recorder.cache, r.Referer(), r.UserAgent()})
+			if aborted != nil {
+				panic(aborted)
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+/**
+ * Reopens the access log every time the process gets a SIGHUP.
+ */
+func reopenOnHangup(l *accessLog) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := l.Reopen(); err != nil {
+				log.Printf("Could not reopen the access log, still writing to the old file: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var combinedLogLine = regexp.MustCompile(
+	`^(\S+) - - \[([^\]]+)\] "([^"]*)" (\d{3}) (\d+|-) "([^"]*)" "([^"]*)" (\d+\.\d{6}) (HIT|MISS|-)$`)
+
+/*
+ *	Sends a request through the access log middleware (in front of the file handler).
+ */
+func requestLogged(l *accessLog, urlpath string) *ResponseWriterTester {
+	resp := genResponseTestWriter()
+	req := genRequestUrl(urlpath)
+	req.Method = "GET"
+	req.Proto = "HTTP/1.1"
+	req.RemoteAddr = "10.0.0.7:51234"
+	req.Header = http.Header{"User-Agent": {"tester/1.0"}}
+	withAccessLog(l, http.HandlerFunc(handler)).ServeHTTP(resp, req)
+	return resp
+}
+
+func readLogLines(path string, t *testing.T) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Could not read the access log: %v", err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// ============ Access Log Tests ============
+
+func TestAccessLogCombinedFormat(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		if filename == "./missing.html" {
+			err = fmt.Errorf("the file does not exist")
+		}
+		data = []byte(fmt.Sprintf("FID:%v", filename[2:]))
+		return
+	})
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := newAccessLog(path, "combined", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	requestLogged(l, "/a.html")
+	requestLogged(l, "/a.html")
+	requestLogged(l, "/missing.html")
+	lines := readLogLines(path, t)
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 access log lines, got: %v", lines)
+	}
+	expected := [][]string{
+		{"10.0.0.7", "GET /a.html HTTP/1.1", "200", "10", "-", "tester/1.0", "MISS"},
+		{"10.0.0.7", "GET /a.html HTTP/1.1", "200", "10", "-", "tester/1.0", "HIT"},
+		{"10.0.0.7", "GET /missing.html HTTP/1.1", fmt.Sprint(userlib.FILEERRORCODE), "", "-", "tester/1.0", "MISS"},
+	}
+	for i, line := range lines {
+		match := combinedLogLine.FindStringSubmatch(line)
+		if match == nil {
+			t.Errorf("Not a combined log line: (%s)", line)
+			continue
+		}
+		if _, err := time.Parse("02/Jan/2006:15:04:05 -0700", match[2]); err != nil {
+			t.Errorf("Bad timestamp in (%s): %v", line, err)
+		}
+		actual := []string{match[1], match[3], match[4], match[5], match[6], match[7], match[9]}
+		if expected[i][3] == "" {
+			actual[3] = "" // The size of the error message is not ours to check.
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(expected[i]) {
+			t.Errorf("Wrong access log line! Expected: (%v), Actual: (%v)", expected[i], actual)
+		}
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestAccessLogJSONFormat(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		data = []byte(fmt.Sprintf("FID:%v", filename[2:]))
+		return
+	})
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := newAccessLog(path, "json", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	requestLogged(l, "/b.html")
+	requestLogged(l, "/b.html")
+	lines := readLogLines(path, t)
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 access log lines, got: %v", lines)
+	}
+	for i, cache := range []string{"MISS", "HIT"} {
+		entry := accessEntry{}
+		if err := json.Unmarshal([]byte(lines[i]), &entry); err != nil {
+			t.Fatalf("Could not parse the access log line (%s): %v", lines[i], err)
+		}
+		if entry.RemoteAddr != "10.0.0.7" || entry.Method != "GET" || entry.URI != "/b.html" ||
+			entry.Status != userlib.SUCCESSCODE || entry.Bytes != 10 || entry.Cache != cache ||
+			entry.UserAgent != "tester/1.0" || entry.Duration < 0 || entry.Time.IsZero() {
+			t.Errorf("Wrong access log entry: (%s)", lines[i])
+		}
+	}
+	if _, err := newAccessLog(path, "xml", 0, 0); err == nil {
+		t.Errorf("Expected an error for an unknown access log format.")
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	entry := &accessEntry{time.Now(), "10.0.0.7", "GET", "/c.html", "HTTP/1.1", 200, 10, 0.001, "HIT", "", ""}
+	lineSize := int64(len(formatCombined(entry)))
+
+	// Rotate by size: 2 lines fit, the third goes to a new file.
+	l, err := newAccessLog(path, "combined", 2*lineSize, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		l.log(entry)
+	}
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 1 || len(readLogLines(rotated[0], t)) != 2 || len(readLogLines(path, t)) != 1 {
+		t.Errorf("The access log was not rotated by size! Rotated files: %v", rotated)
+	}
+	_ = l.Close()
+
+	// Reopen: after logrotate moves the file away, writes go to a fresh file.
+	for _, f := range append(rotated, path) {
+		_ = os.Remove(f)
+	}
+	l, err = newAccessLog(path, "combined", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.log(entry)
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatal(err)
+	}
+	l.log(entry) // Still goes to the moved file.
+	if err := l.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	l.log(entry)
+	if len(readLogLines(path+".moved", t)) != 2 || len(readLogLines(path, t)) != 1 {
+		t.Errorf("The access log was not reopened!")
+	}
+	// A reopen that fails keeps writing to the current file.
+	if err := os.Rename(path, path+".kept"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reopen(); err == nil {
+		t.Errorf("Reopening a directory should have failed!")
+	}
+	l.log(entry)
+	if len(readLogLines(path+".kept", t)) != 2 {
+		t.Errorf("The line logged after a failed reopen was lost!")
+	}
+	_ = l.Close()
+	for _, f := range []string{path, path + ".moved", path + ".kept"} {
+		_ = os.Remove(f)
+	}
+
+	// Rotate by age.
+	l, err = newAccessLog(path, "combined", 0, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.log(entry)
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	l.log(entry)
+	rotated, _ = filepath.Glob(path + ".*")
+	if len(rotated) != 1 || len(readLogLines(path, t)) != 1 {
+		t.Errorf("The access log was not rotated by age! Rotated files: %v", rotated)
+	}
+	_ = l.Close()
+}
+
+func TestAccessLogAbortedResponse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := newAccessLog(path, "combined", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// The client goes away before anything is sent, then in the middle of the body.
+	for _, sent := range []string{"", "partial"} {
+		aborting := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if sent != "" {
+				_, _ = w.Write([]byte(sent))
+			}
+			panic(http.ErrAbortHandler)
+		})
+		func() {
+			defer func() {
+				if r := recover(); r != http.ErrAbortHandler {
+					t.Errorf("The abort should have been passed on! Actual: (%v)", r)
+				}
+			}()
+			req := genRequestUrl("/big.bin")
+			req.Method = "GET"
+			req.Proto = "HTTP/1.1"
+			withAccessLog(l, aborting).ServeHTTP(genResponseTestWriter(), req)
+		}()
+	}
+	lines := readLogLines(path, t)
+	if len(lines) != 2 {
+		t.Fatalf("The aborted responses should have been logged! Actual: (%v)", lines)
+	}
+	for i, expected := range [][]string{{"499", "-"}, {"200", "7"}} {
+		fields := combinedLogLine.FindStringSubmatch(lines[i])
+		if fields == nil || fields[4] != expected[0] || fields[5] != expected[1] {
+			t.Errorf("Wrong status or size! Expected: (%v), Actual: (%s)", expected, lines[i])
+		}
+	}
+}
+
+// ============ End of Access Log Tests ============
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+/**
+ * Admin settings (see main). The admin endpoints are everything under /cache/ and
+ * /metrics. They are open to anyone when no token, credentials or allowlist is set,
+ * and they are served on the main port unless adminAddr is set.
+ */
+var (
+	adminTokenFile    string
+	adminPasswordFile string
+	adminAllowList    string
+	adminAddr         string
+	adminAuth         *adminAccess // Built from the settings above, nil when the endpoints are open.
+)
+
+/**
+ * Access control for the admin endpoints. A request must come from an allowed address
+ * (when there is an allowlist) and carry either the bearer token or valid HTTP Basic
+ * credentials (when either one is set).
+ */
+type adminAccess struct {
+	token   string
+	users   map[string][]byte // User -> bcrypt hash of the password.
+	allowed []*net.IPNet      // Empty to allow every address.
+}
+
+/**
+ * Builds the admin access control from a token file (the token is the whole file, minus
+ * surrounding whitespace), a password file ('user:bcrypt-hash' lines, as written by
+ * 'htpasswd -B') and a comma separated list of IPs and CIDRs. Empty settings are skipped,
+ * nil is returned when they are all empty.
+ */
+func newAdminAccess(tokenFile, passwordFile, allowList string) (*adminAccess, error) {
+	if tokenFile == "" && passwordFile == "" && allowList == "" {
+		return nil, nil
+	}
+	access := &adminAccess{users: make(map[string][]byte)}
+	if tokenFile != "" {
+		data, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the admin token: %v", err)
+		}
+		access.token = strings.TrimSpace(string(data))
+		if access.token == "" {
+			return nil, fmt.Errorf("the admin token file '%s' is empty", tokenFile)
+		}
+	}
+	if passwordFile != "" {
+		if err := access.loadPasswords(passwordFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range strings.Split(allowList, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("bad admin allowlist entry '%s'", entry)
+		}
+		access.allowed = append(access.allowed, network)
+	}
+	return access, nil
+}
+
+func (a *adminAccess) loadPasswords(passwordFile string) error {
+	file, err := os.Open(passwordFile)
+	if err != nil {
+		return fmt.Errorf("could not read the admin passwords: %v", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		colon := strings.Index(text, ":")
+		if colon <= 0 {
+			return fmt.Errorf("%s:%v: expected 'user:bcrypt-hash'", passwordFile, line)
+		}
+		hash := []byte(text[colon+1:])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return fmt.Errorf("%s:%v: the password is not a bcrypt hash", passwordFile, line)
+		}
+		a.users[text[:colon]] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read the admin passwords: %v", err)
+	}
+	if len(a.users) == 0 {
+		return fmt.Errorf("the admin password file '%s' has no users", passwordFile)
+	}
+	return nil
+}
+
+func (a *adminAccess) addressAllowed(remoteAddr string) bool {
+	if len(a.allowed) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range a.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *adminAccess) authorized(r *http.Request) bool {
+	if a.token == "" && len(a.users) == 0 {
+		return true // Only the allowlist is set.
+	}
+	header := r.Header.Get("Authorization")
+	if a.token != "" && len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		token := strings.TrimSpace(header[len("Bearer "):])
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1 {
+			return true
+		}
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		if hash, known := a.users[user]; known {
+			return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+		}
+	}
+	return false
+}
+
+/**
+ * Wraps an admin handler with the access control in adminAuth. Requests from addresses
+ * outside of the allowlist get a 403, requests without valid credentials get a 401.
+ */
+func withAdminAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		access := adminAuth
+		if access == nil {
+			h(w, r)
+			return
+		}
+		if !access.addressAllowed(r.RemoteAddr) {
+			debugLog(fmt.Sprintf("<< [ERROR] Admin request from a refused address: %v '%v'", r.RemoteAddr, r.URL.Path))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if !access.authorized(r) {
+			debugLog(fmt.Sprintf("<< [ERROR] Unauthorized admin request: %v '%v'", r.RemoteAddr, r.URL.Path))
+			if len(access.users) > 0 {
+				w.Header().Add("WWW-Authenticate", `Basic realm="cache admin", charset="UTF-8"`)
+			}
+			if access.token != "" {
+				w.Header().Add("WWW-Authenticate", `Bearer realm="cache admin"`)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
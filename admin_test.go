@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ *	Sends a request through the given routes, from the given address and with the
+ *	given Authorization header (if any).
+ */
+func adminRequest(mux *http.ServeMux, method, urlpath, remoteAddr, authorization string) *ResponseWriterTester {
+	resp := genResponseTestWriter()
+	req := genRequestUrl(urlpath)
+	req.Method = method
+	req.RemoteAddr = remoteAddr
+	req.Header = http.Header{}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	mux.ServeHTTP(resp, req)
+	return resp
+}
+
+func basicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+/*
+ *	Writes the admin token and password files to a temp dir, the passwords are
+ *	hashed with the cheapest bcrypt cost to keep the tests fast.
+ */
+func writeAdminFiles(token string, passwords map[string]string, t *testing.T) (dir, tokenFile, passwordFile string) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenFile = filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	lines := "# cache admins\n"
+	for user, password := range passwords {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines += fmt.Sprintf("%s:%s\n", user, hash)
+	}
+	passwordFile = filepath.Join(dir, "passwd")
+	if err := ioutil.WriteFile(passwordFile, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir, tokenFile, passwordFile
+}
+
+func validateStatus(resp *ResponseWriterTester, expected int, t *testing.T) (failed bool) {
+	if resp.statusCode != expected {
+		failed = true
+		t.Errorf("Received the wrong status code! Expected: (%v), Actual: (%v)", expected, resp.statusCode)
+	}
+	return failed
+}
+
+// ============ Admin Tests ============
+
+func TestAdminConfig(t *testing.T) {
+	dir, tokenFile, passwordFile := writeAdminFiles("secret", map[string]string{"root": "61c"}, t)
+	defer os.RemoveAll(dir)
+	if access, err := newAdminAccess("", "", ""); access != nil || err != nil {
+		t.Errorf("No settings should leave the admin endpoints open! Actual: (%v, %v)", access, err)
+	}
+	access, err := newAdminAccess(tokenFile, passwordFile, "127.0.0.1, 10.0.0.0/8,::1")
+	if err != nil {
+		t.Fatalf("Could not load the admin settings: %v", err)
+	}
+	if access.token != "secret" || len(access.users) != 1 || len(access.allowed) != 3 {
+		t.Errorf("Wrong admin settings! Actual: (token: %q, users: %v, allowed: %v)", access.token, len(access.users), access.allowed)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	ioutil.WriteFile(emptyFile, []byte("\n"), 0600)
+	plainFile := filepath.Join(dir, "plain")
+	ioutil.WriteFile(plainFile, []byte("root:61c\n"), 0600)
+	bad := []struct{ token, passwords, allow string }{
+		{filepath.Join(dir, "missing"), "", ""},
+		{emptyFile, "", ""},
+		{"", emptyFile, ""},
+		{"", plainFile, ""}, // Passwords have to be hashed.
+		{"", "", "not-an-ip"},
+		{"", "", "10.0.0.0/33"},
+	}
+	for _, test := range bad {
+		if _, err := newAdminAccess(test.token, test.passwords, test.allow); err == nil {
+			t.Errorf("Bad admin settings were accepted! (%+v)", test)
+		}
+	}
+}
+
+func TestAdminCredentials(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	dir, tokenFile, passwordFile := writeAdminFiles("secret", map[string]string{"root": "61c"}, t)
+	defer os.RemoveAll(dir)
+	var err error
+	if adminAuth, err = newAdminAccess(tokenFile, passwordFile, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { adminAuth = nil }()
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		data = []byte(fmt.Sprintf("FID:%v", filename[2:]))
+		return
+	})
+	mux := newServeMux(true, true)
+	requestFile("/a.html", secTimeout, t)
+	// Files don't need credentials.
+	validateStatus(adminRequest(mux, http.MethodGet, "/a.html", "192.0.2.1:4000", ""), userlib.SUCCESSCODE, t)
+	refused := []string{"", "Bearer wrong", "Bearer ", "Basic !!!", basicAuth("root", "wrong"), basicAuth("nobody", "61c")}
+	for _, authorization := range refused {
+		for _, url := range []string{"/cache/", "/cache/stats.json", "/metrics"} {
+			resp := adminRequest(mux, http.MethodGet, url, "192.0.2.1:4000", authorization)
+			validateStatus(resp, http.StatusUnauthorized, t)
+			if len(resp.header["Www-Authenticate"]) != 2 {
+				t.Errorf("A refused request should list both schemes! Actual: (%v)", resp.header["Www-Authenticate"])
+			}
+		}
+		validateStatus(adminRequest(mux, http.MethodPost, "/cache/clear/", "192.0.2.1:4000", authorization), http.StatusUnauthorized, t)
+	}
+	validateCacheSize(1, 10, t)
+	for _, authorization := range []string{"Bearer secret", "bearer secret", basicAuth("root", "61c")} {
+		validateStatus(adminRequest(mux, http.MethodGet, "/cache/stats.json", "192.0.2.1:4000", authorization), userlib.SUCCESSCODE, t)
+	}
+	validateStatus(adminRequest(mux, http.MethodPost, "/cache/clear/", "192.0.2.1:4000", "Bearer secret"), userlib.SUCCESSCODE, t)
+	validateCacheSize(0, 0, t)
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestAdminAllowList(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	dir, tokenFile, _ := writeAdminFiles("secret", nil, t)
+	defer os.RemoveAll(dir)
+	mux := newServeMux(true, true)
+	var err error
+	// Only the allowlist, the address is enough.
+	if adminAuth, err = newAdminAccess("", "", "127.0.0.1,10.1.0.0/16,::1"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { adminAuth = nil }()
+	for _, addr := range []string{"127.0.0.1:5000", "10.1.2.3:5000", "[::1]:5000"} {
+		validateStatus(adminRequest(mux, http.MethodGet, "/cache/", addr, ""), userlib.SUCCESSCODE, t)
+	}
+	for _, addr := range []string{"127.0.0.2:5000", "10.2.0.1:5000", "[::2]:5000", ""} {
+		validateStatus(adminRequest(mux, http.MethodGet, "/cache/", addr, ""), http.StatusForbidden, t)
+	}
+	// The allowlist and a token, both are needed.
+	if adminAuth, err = newAdminAccess(tokenFile, "", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	validateStatus(adminRequest(mux, http.MethodGet, "/cache/", "127.0.0.1:5000", ""), http.StatusUnauthorized, t)
+	validateStatus(adminRequest(mux, http.MethodGet, "/cache/", "192.0.2.1:5000", "Bearer secret"), http.StatusForbidden, t)
+	validateStatus(adminRequest(mux, http.MethodGet, "/cache/", "127.0.0.1:5000", "Bearer secret"), userlib.SUCCESSCODE, t)
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestAdminSeparateListener(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		if filename != "./a.html" {
+			return nil, os.ErrNotExist
+		}
+		data = []byte("FID:a.html")
+		return
+	})
+	public := newServeMux(true, false)
+	admin := newServeMux(false, true)
+	requestFile("/a.html", secTimeout, t)
+	// The public routes only know about files, the admin paths are just missing files.
+	for _, url := range []string{"/cache/", "/cache/stats.json", "/metrics"} {
+		validateStatus(adminRequest(public, http.MethodGet, url, "192.0.2.1:4000", ""), userlib.FILEERRORCODE, t)
+	}
+	for _, url := range []string{"/cache/clear/", "/cache/evict/a.html"} {
+		validateStatus(adminRequest(public, http.MethodPost, url, "192.0.2.1:4000", ""), http.StatusMethodNotAllowed, t)
+	}
+	validateCacheSize(1, 10, t)
+	// Readiness checks come from the load balancer, without credentials.
+	validateStatus(adminRequest(public, http.MethodGet, "/ready", "192.0.2.1:4000", ""), userlib.SUCCESSCODE, t)
+	// The admin routes don't serve files.
+	validateStatus(adminRequest(admin, http.MethodGet, "/a.html", "127.0.0.1:4000", ""), http.StatusNotFound, t)
+	validateStatus(adminRequest(admin, http.MethodGet, "/cache/stats.json", "127.0.0.1:4000", ""), userlib.SUCCESSCODE, t)
+	validateStatus(adminRequest(admin, http.MethodPost, "/cache/clear/", "127.0.0.1:4000", ""), userlib.SUCCESSCODE, t)
+	validateCacheSize(0, 0, t)
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+// ============ End of Admin Tests ============
@@ -0,0 +1,1004 @@
+/**
+ * Package cache is the concurrent file cache behind the file server. Every instance
+ * owns its own threads and state, so several independent caches can run in one process.
+ */
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Settings for a cache instance.
+ */
+type Options struct {
+	Capacity    int                     // Number of bytes to allow in the cache.
+	Timeout     time.Duration           // How long a miss waits on the disk before giving up.
+	Dir         string                  // The directory which the files are read from.
+	Eviction    string                  // Eviction policy (see EvictionPolicyNames), random by default.
+	ReadFile    ReadFunc                // Reads a file on a miss, userlib.ReadFile by default.
+	ReadVariant VariantFunc             // Reads a variant of a file on a miss (see GetVariant, optional).
+	CheckFile   func(name string) error // Called on a miss before the file is touched, its error fails the miss (optional).
+	OnRead      func(time.Duration)     // Called with the duration of every disk read (optional).
+	Debug       func(msg string)        // Called with debugging messages (optional).
+
+	/**
+	 * Expiration (optional). TTL gives the time to live of a file (and its variants), 0 to
+	 * never expire. Once expired, a file is still served for StaleWhileRevalidate while it
+	 * is revalidated in the background: if its mod time and size on disk didn't change it
+	 * is kept (for another TTL), otherwise it is read again. When reading an expired file
+	 * fails or times out, its last good copy is served for StaleIfError past its TTL.
+	 */
+	TTL                  func(name string) time.Duration
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+
+	/**
+	 * Files bigger than MaxFileSize (0 for no limit), or than the capacity with
+	 * LimitToCapacity, are not read on a miss. Get returns ErrTooLarge for them instead,
+	 * so they can be streamed off the disk. Files whose size is unknown are read anyway.
+	 */
+	MaxFileSize     int64
+	LimitToCapacity bool
+
+	/**
+	 * Files of at least MmapSize bytes (0 to never) are memory-mapped read-only instead of
+	 * read into the heap, so they don't weigh on the garbage collector. Their mapped bytes
+	 * count against the capacity like any other data. Mapped files must be released once
+	 * they are sent (see File.Release), and read through File.ReadData. Hits don't stat
+	 * the file: a mapped file is dropped when a revalidation (see TTL) finds it changed on
+	 * disk, or by the caller when reading it fails with ErrFileChanged (it was truncated in
+	 * place). Variants are never mapped.
+	 */
+	MmapSize int64
+
+	/**
+	 * Second tier on the local disk (optional). With a DiskDir, the files that leave the
+	 * memory (evicted, or still cached on Close) are kept there, up to DiskCapacity
+	 * bytes (the least recently used go first), and a miss looks there before reading the
+	 * file. Clear empties it too. A copy is only used while the file's mod time and size on disk are the same.
+	 * The tier survives restarts: New reloads its most hit files (as many as fit in the
+	 * capacity) into memory in the background. Variants are not kept.
+	 */
+	DiskDir      string
+	DiskCapacity int64
+}
+
+/**
+ * A file handed out by the cache. The data is shared with the cache, so it must NOT be modified.
+ */
+type File struct {
+	Name    string
+	Variant string // Empty for the file itself, e.g. "gzip" for its gzip encoding (see GetVariant).
+	Data    []byte
+	Validators
+	Hit   bool // Whether the file came from the cache (as opposed to the disk).
+	Stale bool // Whether the file expired, and is served while it is revalidated or since reading it failed.
+
+	mapping *mapping // The reference this file holds on its mapped data (nil on the heap).
+}
+
+var (
+	ErrTimeout     = errors.New("timed out reading the file")
+	ErrClosed      = errors.New("the cache is closed")
+	ErrTooLarge    = errors.New("the file is too large to cache")
+	ErrFileChanged = errors.New("the mapped file changed on disk") // See File.ReadData.
+)
+
+/**
+ * A cache instance. It is made of two threads: operateCache handles the requests and
+ * the misses, and mapOperator owns the cache table (and eviction policy), thus avoiding
+ * any data races. Every disk read runs in its own thread (cacheMiss).
+ */
+type Cache struct {
+	options        Options
+	fileChan       chan *fileRequest
+	cacheOpChan    chan *cacheOp
+	cacheMissChan  chan *missResponse
+	cacheStatsChan chan *statsRequest
+	cacheClearChan chan chan bool
+	cacheCloseChan chan bool
+	abandonChan    chan *fileRequest
+	closed         chan bool // Closed once the cache is closed for good.
+	closeOnce      sync.Once
+	readCtx        context.Context // Parent of every read's context, canceled by Close.
+	cancelReads    context.CancelFunc
+	missThreads    sync.WaitGroup // Running cacheMiss threads, see Shutdown.
+	capacity       int64          // Only changed by the map operator (see Resize), read atomically.
+	timeout        int64          // Nanoseconds, see SetTimeout. Read atomically.
+	mappedBytes    int64          // Bytes currently memory-mapped (see mapping), changed atomically.
+	disk           *diskTier      // The second tier (see Options.DiskDir), nil without one.
+	diskWrites     sync.WaitGroup // Disk tier operations in the background, see diskOp.
+
+	/**
+	 * In-flight cache misses of the current generation, keyed by filename. Only
+	 * operateCache touches this map. A clear starts a new generation (and an empty map),
+	 * the older misses still answer their requests but never write into the cache.
+	 */
+	pendingMisses map[string]*pendingMiss
+	generation    uint64
+
+	/**
+	 * Number of invalidations so far, only changed by the map operator (read atomically).
+	 * A read that started before the last one may hold the content from before the change,
+	 * so its data is never written into the cache (it still answers its requests).
+	 */
+	invalidations uint64
+
+	/**
+	 * Counters that outlive a cache clear. Each one is only touched by the thread that
+	 * owns it (see Stats), and the two cache threads never run twice at once.
+	 */
+	hits, misses, timeouts, fileErrors, evictions, staleHits, tooLarge uint64
+}
+
+/**
+ * Internal structures for communication between threads.
+ */
+type fileRequest struct {
+	filename   string
+	response   chan *fileResponse // Buffered, so an abandoned request never blocks the cache.
+	cachedOnly bool               // Don't read the file on a miss, respond with a nil file instead.
+	miss       *pendingMiss       // The miss this request waits on (if any). Only operateCache touches it.
+}
+
+/**
+ * An in-flight cache miss. The read is canceled once every request waiting on it gave up.
+ */
+type pendingMiss struct {
+	requests      []*fileRequest
+	cancel        context.CancelFunc
+	generation    uint64      // Generation of the cache that the read data goes into.
+	invalidations uint64      // Invalidations before the read started (see Cache.invalidations).
+	stale         *cacheEntry // The expired entry this miss revalidates (if any).
+}
+
+type fileResponse struct {
+	file *File
+	err  error
+}
+
+type missResponse struct {
+	filename   string
+	miss       *pendingMiss
+	data       []byte
+	err        error
+	validators Validators
+	stale      bool     // The read failed (err), the data is the last good copy.
+	mapping    *mapping // The reference the response holds on its data (if mapped).
+}
+
+type cacheEntry struct {
+	filename   string
+	data       []byte
+	count      int // Number of cache hits.
+	validators Validators
+	expires    time.Time // Zero if the entry never expires.
+	stamp      fileStamp // The file on disk when it was read, to revalidate against.
+	mapping    *mapping  // The reference the cache table holds on the data (if mapped).
+}
+
+/**
+ * Releases the reference on the entry's data held by whoever got the entry from the map
+ * operator: the table itself, operateCache after a read (see opRead) or a pending miss.
+ */
+func (entry *cacheEntry) release() {
+	if entry != nil {
+		entry.mapping.release()
+	}
+}
+
+/**
+ * Whether the entry expired at the given time (entries without a TTL never do).
+ */
+func (entry *cacheEntry) expired(now time.Time) bool {
+	return !entry.expires.IsZero() && !now.Before(entry.expires)
+}
+
+type cacheTable struct {
+	table map[string]*cacheEntry
+	size  int // Size of ALL data (values) in bytes
+}
+
+const (
+	opWrite = iota
+	opRead
+	opInvalidate
+	opInvalidatePrefix
+	opStats
+	opClear
+	opResize
+	opRefresh
+)
+
+type cacheOp struct {
+	op            int
+	filename      string
+	data          []byte
+	readChan      chan *cacheEntry
+	validators    Validators
+	stats         *Stats    // Filled in by the map operator for opStats.
+	generation    uint64    // Cache generation of an opWrite (opClear starts the next one).
+	invalidations uint64    // Invalidations before the read of an opWrite or opRefresh started.
+	capacity      int       // New capacity for opResize.
+	expires       time.Time // Expiration of an opWrite or opRefresh.
+	stamp         fileStamp // File stamp of an opWrite or opRefresh.
+	mapping       *mapping  // Mapped data of an opWrite, with a reference for the table.
+}
+
+/**
+ * Builds a cache and starts its threads.
+ */
+func New(options Options) (*Cache, error) {
+	if options.Eviction == "" {
+		options.Eviction = "random"
+	}
+	if _, err := newEvictionPolicy(options.Eviction); err != nil {
+		return nil, err
+	}
+	if options.ReadFile == nil {
+		// Looked up on every read, so userlib.ReplaceReadFile keeps working.
+		options.ReadFile = IgnoreContext(func(dir, name string) ([]byte, error) {
+			return userlib.ReadFile(dir, name)
+		})
+	}
+	var disk *diskTier
+	if options.DiskDir != "" {
+		var err error
+		if disk, err = openDiskTier(options.DiskDir, options.DiskCapacity); err != nil {
+			return nil, err
+		}
+	}
+	readCtx, cancelReads := context.WithCancel(context.Background())
+	c := &Cache{
+		options:        options,
+		fileChan:       make(chan *fileRequest),
+		cacheOpChan:    make(chan *cacheOp),
+		cacheMissChan:  make(chan *missResponse),
+		cacheStatsChan: make(chan *statsRequest),
+		cacheClearChan: make(chan chan bool),
+		cacheCloseChan: make(chan bool),
+		abandonChan:    make(chan *fileRequest),
+		closed:         make(chan bool),
+		readCtx:        readCtx,
+		cancelReads:    cancelReads,
+		pendingMisses:  make(map[string]*pendingMiss),
+		capacity:       int64(options.Capacity),
+		timeout:        int64(options.Timeout),
+		disk:           disk,
+	}
+	go c.operateCache()
+	if disk != nil {
+		go c.preloadFromDisk()
+	}
+	return c, nil
+}
+
+func (c *Cache) debug(format string, args ...interface{}) {
+	if c.options.Debug != nil {
+		c.options.Debug(fmt.Sprintf(format, args...))
+	}
+}
+
+/**
+ * Gets a file from the cache, reading it from the disk on a miss. Concurrent misses on
+ * the same file share a single read. The error is ErrTimeout if the read took longer
+ * than the timeout, the read error if it failed, or the context's error if it is done
+ * first. In that last case the request stops waiting right away, and the read itself
+ * is canceled if no other request is waiting on it.
+ */
+func (c *Cache) Get(ctx context.Context, name string) (*File, error) {
+	return c.request(ctx, name, false)
+}
+
+/**
+ * Gets a variant of a file (e.g. an encoding of it), reading it with Options.ReadVariant
+ * on a miss. Variants are cached next to the file itself and count against the capacity.
+ * A file without such a variant gets an empty one (which is cached as well, so the disk
+ * is only checked once).
+ */
+func (c *Cache) GetVariant(ctx context.Context, name, variant string) (*File, error) {
+	return c.request(ctx, variantKey(name, variant), false)
+}
+
+/**
+ * Gets a file only if it is cached (nil otherwise), without ever touching the disk. An
+ * expired file within StaleWhileRevalidate is handed out stale, but not revalidated.
+ */
+func (c *Cache) GetCached(name string) *File {
+	file, _ := c.request(context.Background(), name, true)
+	return file
+}
+
+func (c *Cache) request(ctx context.Context, name string, cachedOnly bool) (*File, error) {
+	request := fileRequest{name, make(chan *fileResponse, 1), cachedOnly, nil}
+	select {
+	case c.fileChan <- &request:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.closed:
+		return nil, ErrClosed
+	}
+	select {
+	case response := <-request.response:
+		return response.file, response.err
+	case <-ctx.Done():
+		select {
+		case c.abandonChan <- &request:
+			select {
+			case response := <-request.response: // Answered before it was abandoned.
+				response.file.Release()
+			default:
+			}
+		case <-c.closed:
+		}
+		return nil, ctx.Err()
+	case <-c.closed:
+		return nil, ErrClosed
+	}
+}
+
+/**
+ * Drops a file (Invalidate) or every file under a path prefix (InvalidatePrefix)
+ * from the cache, without waiting for it to happen. Variants go along with their file.
+ */
+func (c *Cache) Invalidate(name string) {
+	c.sendOp(&cacheOp{opInvalidate, name, nil, nil, Validators{}, nil, 0, 0, 0, time.Time{}, fileStamp{}, nil})
+}
+
+func (c *Cache) InvalidatePrefix(prefix string) {
+	c.sendOp(&cacheOp{opInvalidatePrefix, prefix, nil, nil, Validators{}, nil, 0, 0, 0, time.Time{}, fileStamp{}, nil})
+}
+
+/**
+ * Same as Invalidate and InvalidatePrefix, but waits for the eviction and returns the
+ * removed files (sorted by name), which hold on to their data until released (see
+ * ReleaseFiles).
+ */
+func (c *Cache) Evict(name string) []*File {
+	return c.evict(opInvalidate, name)
+}
+
+func (c *Cache) EvictPrefix(prefix string) []*File {
+	return c.evict(opInvalidatePrefix, prefix)
+}
+
+func (c *Cache) evict(op int, filename string) []*File {
+	return c.collectRemoved(&cacheOp{op, filename, nil, make(chan *cacheEntry), Validators{}, nil, 0, 0, 0, time.Time{}, fileStamp{}, nil})
+}
+
+/**
+ * Changes the capacity without clearing the cache. When it shrinks, files are evicted
+ * (in the order of the eviction policy) until the cache fits, the evicted files are
+ * returned (sorted by name, see Evict). A negative capacity counts as 0.
+ */
+func (c *Cache) Resize(capacity int) []*File {
+	if capacity < 0 {
+		capacity = 0
+	}
+	return c.collectRemoved(&cacheOp{opResize, "", nil, make(chan *cacheEntry), Validators{}, nil, 0, 0, capacity, time.Time{}, fileStamp{}, nil})
+}
+
+/**
+ * The current capacity (see Resize).
+ */
+func (c *Cache) Capacity() int {
+	return int(atomic.LoadInt64(&c.capacity))
+}
+
+/**
+ * Changes how long the misses that start from now on wait on the disk.
+ */
+func (c *Cache) SetTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&c.timeout, int64(timeout))
+}
+
+/**
+ * Sends an operation that removes entries to the map operator and collects the
+ * removed files (sorted by name) from its read channel.
+ */
+func (c *Cache) collectRemoved(cacheOp *cacheOp) []*File {
+	removed := []*File{}
+	if !c.sendOp(cacheOp) {
+		return removed
+	}
+	for entry := range cacheOp.readChan { // The map operator closes it once it is done.
+		removed = append(removed, entry.file(true))
+	}
+	sort.Slice(removed, func(i, j int) bool {
+		if removed[i].Name == removed[j].Name {
+			return removed[i].Variant < removed[j].Variant
+		}
+		return removed[i].Name < removed[j].Name
+	})
+	return removed
+}
+
+/**
+ * Sends an operation to the map operator, returns false if the cache is closed.
+ */
+func (c *Cache) sendOp(cacheOp *cacheOp) bool {
+	select {
+	case c.cacheOpChan <- cacheOp:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+/**
+ * Empties the cache and waits for it to happen, the disk tier (if any) is emptied in the
+ * background. The counters (see Stats) are kept.
+ * Clears can run concurrently with each other and with any other cache call. Misses
+ * that are in flight during a clear still answer their requests, but their data is
+ * NOT cached since it may predate the clear.
+ */
+func (c *Cache) Clear() {
+	done := make(chan bool, 1)
+	select {
+	case c.cacheClearChan <- done:
+		<-done
+	case <-c.closed:
+	}
+}
+
+/**
+ * Stops the cache threads. Requests waiting on the cache get ErrClosed and reads that
+ * are still in flight are dropped once they finish.
+ */
+func (c *Cache) Close() {
+	c.closeOnce.Do(func() {
+		c.cacheCloseChan <- true
+		<-c.cacheCloseChan
+		close(c.closed)
+		c.cancelReads()
+		if c.disk != nil {
+			c.diskWrites.Wait() // Holds the files that were cached, see mapOperator.
+			if err := c.disk.close(); err != nil {
+				c.debug("[!] Could not save the disk cache index: %v", err)
+			}
+		}
+	})
+}
+
+/**
+ * Same as Close, but also waits for the cacheMiss threads to finish (their reads are
+ * canceled by the close). If ctx is done first, its error is returned and the threads
+ * that are still running are left behind.
+ */
+func (c *Cache) Shutdown(ctx context.Context) error {
+	c.Close()
+	done := make(chan bool)
+	go func() {
+		c.missThreads.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/**
+ * This thread is spawned once from the main cache thread (operateCache) during its initialization.
+ * It handles all map operations for the cache, thus avoiding any data races.
+ */
+func (c *Cache) mapOperator(closeChan chan bool) {
+	cache := cacheTable{make(map[string]*cacheEntry), 0}
+	policy, _ := newEvictionPolicy(c.options.Eviction) // Checked by New.
+	var generation uint64
+	// Evicts (in the policy's order) until the cache size is at most limit. The evicted
+	// entries are sent on the removed channel (if there is one).
+	evictUntil := func(limit int, removed chan *cacheEntry) {
+		for cache.size > limit {
+			victim, ok := policy.Victim()
+			if !ok {
+				break
+			}
+			c.debug("\t\t\tEvicting %v from cache", victim)
+			delEntry := cache.table[victim]
+			delete(cache.table, victim)
+			policy.Remove(victim)
+			cache.size -= len(delEntry.data)
+			c.evictions++
+			c.spill(delEntry)
+			if removed != nil {
+				delEntry.mapping.acquire() // For the removed file.
+				removed <- delEntry
+			}
+			delEntry.release()
+		}
+	}
+	defer func() {
+		// The mapped files are unmapped once the files that are still out are released.
+		for _, entry := range cache.table {
+			c.spill(entry)
+			entry.release()
+		}
+		closeChan <- false
+	}()
+	for {
+		select { // Drain the close channel first.
+		case <-closeChan:
+			return
+		default:
+		}
+
+		select {
+		case <-closeChan:
+			return
+		case cacheOp := <-c.cacheOpChan:
+			switch cacheOp.op {
+			case opWrite:
+				if cacheOp.generation != generation {
+					c.debug("\t\t\tDropping %v, it was read before a clear", cacheOp.filename)
+					cacheOp.mapping.release()
+					continue
+				}
+				if cacheOp.invalidations != atomic.LoadUint64(&c.invalidations) {
+					c.debug("\t\t\tDropping %v, it was read before an invalidation", cacheOp.filename)
+					cacheOp.mapping.release()
+					continue
+				}
+				if len(cacheOp.data) > c.Capacity() {
+					cacheOp.mapping.release()
+					continue // Don't destroy cache if cache can't fit data.
+				}
+				c.debug("\t\t\tAdding %v to cache", cacheOp.filename)
+				if entry, ok := cache.table[cacheOp.filename]; ok {
+					delete(cache.table, cacheOp.filename)
+					policy.Remove(cacheOp.filename)
+					cache.size -= len(entry.data)
+					entry.release()
+				}
+				evictUntil(c.Capacity()-len(cacheOp.data), nil)
+				cache.table[cacheOp.filename] = &cacheEntry{cacheOp.filename,
+					cacheOp.data, 0, cacheOp.validators, cacheOp.expires, cacheOp.stamp, cacheOp.mapping}
+				policy.Insert(cacheOp.filename)
+				cache.size += len(cacheOp.data)
+			case opRefresh:
+				entry, ok := cache.table[cacheOp.filename]
+				if !ok || cacheOp.generation != generation || cacheOp.invalidations != atomic.LoadUint64(&c.invalidations) {
+					continue // Evicted, cleared or invalidated while it was revalidated.
+				}
+				c.debug("\t\t\tRefreshing %v, it did not change on disk", cacheOp.filename)
+				// Replaced (not changed in place), operateCache may still read the old entry.
+				refreshed := *entry
+				refreshed.expires, refreshed.stamp = cacheOp.expires, cacheOp.stamp
+				cache.table[cacheOp.filename] = &refreshed
+			case opRead:
+				entry, ok := cache.table[cacheOp.filename]
+				if ok {
+					entry.count++
+					policy.Hit(cacheOp.filename)
+					entry.mapping.acquire() // For operateCache, see cacheEntry.release.
+				}
+				cacheOp.readChan <- entry // nil on a miss.
+			case opInvalidate, opInvalidatePrefix:
+				atomic.AddUint64(&c.invalidations, 1) // The reads in flight may be older than the change.
+				// Removed entries are sent back on the read channel (if there is one).
+				for k, entry := range cache.table {
+					if k == cacheOp.filename || strings.HasPrefix(k, cacheOp.filename+variantSep) ||
+						(cacheOp.op == opInvalidatePrefix && strings.HasPrefix(k, cacheOp.filename)) {
+						c.debug("\t\t\tInvalidating %v", k)
+						delete(cache.table, k)
+						policy.Remove(k)
+						cache.size -= len(entry.data)
+						if cacheOp.readChan != nil {
+							entry.mapping.acquire() // For the removed file.
+							cacheOp.readChan <- entry
+						}
+						entry.release()
+					}
+				}
+				if c.disk != nil { // The copy on disk goes too, or the next miss would bring it back.
+					name, prefix := cacheOp.filename, cacheOp.op == opInvalidatePrefix
+					c.diskOp(func() { c.disk.drop(name, prefix) })
+				}
+				if cacheOp.readChan != nil {
+					close(cacheOp.readChan)
+				}
+			case opClear:
+				c.debug("\t\t\tClearing the cache")
+				for _, entry := range cache.table {
+					entry.release()
+				}
+				if c.disk != nil { // Both tiers, or the next miss would bring a file back.
+					c.diskOp(c.disk.clear)
+				}
+				cache = cacheTable{make(map[string]*cacheEntry), 0}
+				policy, _ = newEvictionPolicy(c.options.Eviction)
+				generation++
+			case opResize:
+				c.debug("\t\t\tResizing the cache to %v bytes", cacheOp.capacity)
+				atomic.StoreInt64(&c.capacity, int64(cacheOp.capacity))
+				evictUntil(cacheOp.capacity, cacheOp.readChan)
+				close(cacheOp.readChan)
+			case opStats:
+				cacheOp.stats.Items = len(cache.table)
+				cacheOp.stats.BytesUsed = cache.size
+				cacheOp.stats.Evictions = c.evictions
+				cacheOp.stats.MappedBytes = atomic.LoadInt64(&c.mappedBytes) // After the earlier removals.
+				cacheOp.stats.TopKeys = topKeysByHits(cache.table, cacheOp.stats.topN)
+				cacheOp.readChan <- nil
+			}
+		}
+	}
+}
+
+/**
+ * This thread is spawned from the main cache thread (operateCache) every time a file
+ * misses and no other read of it is in flight. This enables concurrent file reads.
+ * Also, this thread hands the result back to operateCache (through cacheMissChan)
+ * once it reads AND caches data (or when timeout occurs), which then answers every
+ * request waiting on that file.
+ * NOTE: Thread stays active until the read data is cached (even when timing out).
+ * A timeout does NOT cancel the read (a late read still fills the cache), only
+ * abandoning the miss (see Get) or closing the cache does.
+ */
+func (c *Cache) cacheMiss(ctx context.Context, filename string, miss *pendingMiss) {
+	defer c.missThreads.Done() // Deferred first, so it runs after the read is done.
+	defer miss.stale.release() // Once the read is done, the responses hold their own references.
+	processedChan := make(chan *missResponse, 1)
+
+	go func() {
+		defer miss.cancel()
+		name, variant := splitKey(filename)
+		if c.options.CheckFile != nil {
+			if err := c.options.CheckFile(name); err != nil {
+				processedChan <- &missResponse{filename, miss, nil, err, Validators{}, false, nil}
+				return
+			}
+		}
+		stamp := statFile(c.options.Dir, name) // Stat first, so a concurrent write can't make it look newer.
+		expires := c.expiry(name)
+		if c.exceedsLimit(stamp) {
+			if miss.stale != nil {
+				c.Invalidate(name) // It grew too large, the cached copy is gone for good.
+			}
+			processedChan <- &missResponse{filename, miss, nil, ErrTooLarge, Validators{}, false, nil}
+			return
+		}
+		if stale := miss.stale; stale != nil && stamp.known() && stamp.equal(stale.stamp) {
+			// Revalidated, no need to read it again.
+			c.sendOp(&cacheOp{opRefresh, filename, nil, nil, Validators{}, nil, miss.generation, miss.invalidations, 0, expires, stamp, nil})
+			stale.mapping.acquire()
+			processedChan <- &missResponse{filename, miss, stale.data, nil, stale.validators, false, stale.mapping}
+			return
+		}
+		var data []byte
+		var mapped *mapping
+		var validators Validators
+		var fromDisk bool
+		var err error
+		if variant == "" {
+			readStart := time.Now()
+			if data, mapped, validators, fromDisk = c.readFromDisk(name, stamp); fromDisk {
+				c.debug("\t\t[*] Read %v from the disk cache", filename)
+			} else if c.options.MmapSize > 0 && stamp.size >= c.options.MmapSize {
+				if mapped, err = c.mapFile(filepath.Join(c.options.Dir, name), stamp); err == nil {
+					data = mapped.data
+					// Hashing reads every page, it may race a truncation too.
+					if err = guardFaults(func() error {
+						validators = NewValidators(data, stamp.modTime)
+						return nil
+					}); err != nil {
+						mapped.release()
+						mapped = nil
+					}
+				}
+				if err != nil {
+					c.debug("\t\t[!] Could not map %v, reading it: %v", filename, err)
+				}
+			}
+			if mapped == nil && !fromDisk {
+				data, err = c.options.ReadFile(ctx, c.options.Dir, name)
+			}
+			if c.options.OnRead != nil {
+				c.options.OnRead(time.Now().Sub(readStart))
+			}
+		} else if c.options.ReadVariant != nil {
+			data, err = c.options.ReadVariant(ctx, c.options.Dir, name, variant)
+		}
+		if err != nil {
+			// Don't cache if it's a file error.
+			processedChan <- c.errorResponse(filename, miss, err)
+		} else {
+			if !fromDisk && mapped == nil { // Mapped files are hashed above.
+				validators = NewValidators(data, stamp.modTime)
+			}
+			mapped.acquire() // For the cache table.
+			if !c.sendOp(&cacheOp{opWrite, filename, data, nil, validators, nil, miss.generation, miss.invalidations, 0, expires, stamp, mapped}) {
+				mapped.release()
+			}
+			processedChan <- &missResponse{filename, miss, data, nil, validators, false, mapped}
+		}
+	}()
+
+	var response *missResponse
+	select {
+	case response = <-processedChan:
+	case <-time.After(time.Duration(atomic.LoadInt64(&c.timeout))):
+		c.debug("\t\t[!!] Time out: %v", filename)
+		response = c.errorResponse(filename, miss, ErrTimeout)
+		defer func() { // Don't close thread until read file is cached.
+			late := <-processedChan
+			late.mapping.release()
+		}()
+	}
+	select {
+	case c.cacheMissChan <- response:
+	case <-c.closed:
+		response.mapping.release()
+	}
+}
+
+/**
+ * The response to a miss whose read failed (or timed out): the last good copy of an
+ * expired file that is still within Options.StaleIfError, the error otherwise.
+ */
+func (c *Cache) errorResponse(filename string, miss *pendingMiss, err error) *missResponse {
+	if stale := miss.stale; stale != nil && time.Now().Before(stale.expires.Add(c.options.StaleIfError)) {
+		c.debug("\t\t[~] Serving stale %v after: %v", filename, err)
+		stale.mapping.acquire()
+		return &missResponse{filename, miss, stale.data, err, stale.validators, true, stale.mapping}
+	}
+	return &missResponse{filename, miss, nil, err, Validators{}, false, nil}
+}
+
+/**
+ * Reads the copy of a file from the disk tier, if it has one of the file as it is on disk
+ * now (see stamp). It is mapped like the file itself would be (see Options.MmapSize).
+ */
+func (c *Cache) readFromDisk(name string, stamp fileStamp) ([]byte, *mapping, Validators, bool) {
+	if c.disk == nil {
+		return nil, nil, Validators{}, false
+	}
+	path, size, validators := c.disk.lookup(name, stamp)
+	if path == "" {
+		return nil, nil, Validators{}, false
+	}
+	var data []byte
+	var mapped *mapping
+	var err error
+	if c.options.MmapSize > 0 && size >= c.options.MmapSize {
+		if mapped, err = c.mapFile(path, fileStamp{time.Time{}, -1}); err == nil { // Checked below.
+			data = mapped.data
+		}
+	}
+	if mapped == nil {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil || int64(len(data)) != size {
+		c.debug("\t\t[!] Dropping the broken disk cache copy of %v: %v", name, err)
+		mapped.release()
+		c.disk.drop(name, false)
+		return nil, nil, Validators{}, false
+	}
+	atomic.AddUint64(&c.disk.hits, 1)
+	return data, mapped, validators, true
+}
+
+/**
+ * Hands a file that leaves the memory (evicted or closed) over to the disk tier,
+ * in the background. Variants and files that can't be revalidated are not kept.
+ */
+func (c *Cache) spill(entry *cacheEntry) {
+	if c.disk == nil || !entry.stamp.known() || strings.Contains(entry.filename, variantSep) {
+		return
+	}
+	filename, data, validators, stamp, hits := entry.filename, entry.data, entry.validators, entry.stamp, entry.count
+	clears := atomic.LoadUint64(&c.disk.clears)
+	mapped := entry.mapping
+	mapped.acquire() // Until it is written.
+	c.diskOp(func() {
+		defer mapped.release()
+		if err := c.disk.store(filename, data, validators, stamp, hits, clears); err != nil {
+			c.debug("\t\t\t[!] Could not keep %v in the disk cache: %v", filename, err)
+		}
+	})
+}
+
+/**
+ * Runs a disk tier operation in the background, so the map operator never waits on the
+ * disk. Close waits for them.
+ */
+func (c *Cache) diskOp(op func()) {
+	c.diskWrites.Add(1)
+	go func() {
+		defer c.diskWrites.Done()
+		op()
+	}()
+}
+
+/**
+ * Reads the most hit files of the disk tier (as many as fit in the capacity) back into
+ * memory, through the normal miss path. Runs once, when the cache is built.
+ */
+func (c *Cache) preloadFromDisk() {
+	names := c.disk.hottest(int64(c.Capacity()))
+	for _, name := range names {
+		file, err := c.Get(c.readCtx, name)
+		if err == ErrClosed || c.readCtx.Err() != nil {
+			return
+		}
+		file.Release()
+	}
+	c.debug("[*] Preloaded %v files from the disk cache", len(names))
+}
+
+/**
+ * Whether a file is too large to be read into the cache (see Options.MaxFileSize).
+ */
+func (c *Cache) exceedsLimit(stamp fileStamp) bool {
+	if !stamp.known() {
+		return false
+	}
+	return (c.options.MaxFileSize > 0 && stamp.size > c.options.MaxFileSize) ||
+		(c.options.LimitToCapacity && stamp.size > int64(c.Capacity()))
+}
+
+/**
+ * The expiration of a file read now, zero if it never expires (see Options.TTL).
+ */
+func (c *Cache) expiry(name string) time.Time {
+	if c.options.TTL == nil {
+		return time.Time{}
+	}
+	if ttl := c.options.TTL(name); ttl > 0 {
+		return time.Now().Add(ttl)
+	}
+	return time.Time{}
+}
+
+/**
+ * Starts a cacheMiss thread for filename, answering fileReq (if any) once it is done.
+ * The stale entry (if any) is the expired copy of the file that the miss revalidates,
+ * the miss takes over a reference on its data (if mapped).
+ */
+func (c *Cache) startMiss(filename string, fileReq *fileRequest, stale *cacheEntry) {
+	ctx, cancel := context.WithCancel(c.readCtx)
+	miss := &pendingMiss{nil, cancel, c.generation, atomic.LoadUint64(&c.invalidations), stale}
+	if fileReq != nil {
+		miss.requests = []*fileRequest{fileReq}
+		fileReq.miss = miss
+	}
+	c.pendingMisses[filename] = miss
+	c.missThreads.Add(1)
+	go c.cacheMiss(ctx, filename, miss)
+}
+
+/**
+ * This thread handles all cache file requests at runtime and spawns off
+ * all of the necessary threads at runtime.
+ */
+func (c *Cache) operateCache() {
+	mapOpCloseChan := make(chan bool)
+	go c.mapOperator(mapOpCloseChan)
+
+	for {
+		select {
+		case fileReq := <-c.fileChan:
+			cacheOp := cacheOp{opRead, fileReq.filename, nil, make(chan *cacheEntry), Validators{}, nil, 0, 0, 0, time.Time{}, fileStamp{}, nil}
+			c.cacheOpChan <- &cacheOp
+			cacheEntry := <-cacheOp.readChan // Holds a reference on the data (if mapped).
+			now := time.Now()
+			if cacheEntry != nil && !cacheEntry.expired(now) {
+				c.debug("\t[*]Hit: %v", fileReq.filename)
+				c.hits++
+				fileReq.response <- &fileResponse{cacheEntry.file(true), nil}
+			} else if cacheEntry != nil && now.Before(cacheEntry.expires.Add(c.options.StaleWhileRevalidate)) {
+				c.debug("\t[*]Stale hit: %v", fileReq.filename)
+				c.hits++
+				c.staleHits++
+				_, revalidating := c.pendingMisses[fileReq.filename]
+				revalidate := !revalidating && !fileReq.cachedOnly // GetCached never touches the disk.
+				if revalidate {
+					cacheEntry.mapping.acquire() // Before the file is sent, it may be released right away.
+				}
+				file := cacheEntry.file(true)
+				file.Stale = true
+				fileReq.response <- &fileResponse{file, nil}
+				if revalidate {
+					c.debug("\t[~]Revalidating: %v", fileReq.filename)
+					c.startMiss(fileReq.filename, nil, cacheEntry)
+				}
+			} else if fileReq.cachedOnly {
+				cacheEntry.release()
+				fileReq.response <- &fileResponse{nil, nil}
+			} else if miss, ok := c.pendingMisses[fileReq.filename]; ok {
+				c.debug("\t[~]Miss (joined in-flight read): %v", fileReq.filename)
+				c.misses++
+				cacheEntry.release()
+				miss.requests = append(miss.requests, fileReq)
+				fileReq.miss = miss
+			} else {
+				c.debug("\t[!]Miss: %v", fileReq.filename)
+				c.misses++
+				c.startMiss(fileReq.filename, fileReq, cacheEntry) // An expired entry is kept for stale-if-error.
+			}
+		case fileReq := <-c.abandonChan:
+			miss := fileReq.miss
+			if miss == nil {
+				continue // Already answered.
+			}
+			for i, waiting := range miss.requests {
+				if waiting == fileReq {
+					miss.requests = append(miss.requests[:i], miss.requests[i+1:]...)
+					break
+				}
+			}
+			if len(miss.requests) == 0 {
+				c.debug("\t[x]Miss abandoned: %v", fileReq.filename)
+				miss.cancel()
+				if c.pendingMisses[fileReq.filename] == miss {
+					delete(c.pendingMisses, fileReq.filename)
+				}
+			}
+		case missResponse := <-c.cacheMissChan:
+			miss := missResponse.miss
+			if c.pendingMisses[missResponse.filename] == miss {
+				delete(c.pendingMisses, missResponse.filename)
+			}
+			if len(miss.requests) == 0 {
+				missResponse.mapping.release()
+				continue // Nobody waits on an abandoned miss.
+			}
+			if missResponse.err == ErrTimeout {
+				c.timeouts++
+			} else if missResponse.err == ErrTooLarge {
+				c.tooLarge++
+			} else if missResponse.err != nil {
+				c.fileErrors++
+			}
+			if missResponse.stale {
+				c.staleHits += uint64(len(miss.requests))
+			}
+			entry := cacheEntry{missResponse.filename, missResponse.data, 0, missResponse.validators,
+				time.Time{}, fileStamp{}, missResponse.mapping}
+			for _, fileReq := range miss.requests {
+				response := &fileResponse{nil, missResponse.err}
+				if missResponse.err == nil || missResponse.stale {
+					// Every request gets its own file, with its own reference on the data.
+					entry.mapping.acquire()
+					response = &fileResponse{entry.file(false), nil}
+					response.file.Stale = missResponse.stale
+				}
+				fileReq.miss = nil
+				fileReq.response <- response
+			}
+			missResponse.mapping.release()
+			miss.requests = nil
+		case statsReq := <-c.cacheStatsChan:
+			stats := &Stats{Capacity: c.Capacity(), Hits: c.hits, Misses: c.misses,
+				Timeouts: c.timeouts, FileErrors: c.fileErrors, StaleHits: c.staleHits,
+				TooLarge: c.tooLarge, InFlightMisses: len(c.pendingMisses), topN: statsReq.topN}
+			cacheOp := cacheOp{opStats, "", nil, make(chan *cacheEntry), Validators{}, stats, 0, 0, 0, time.Time{}, fileStamp{}, nil}
+			c.cacheOpChan <- &cacheOp
+			<-cacheOp.readChan
+			statsReq.response <- stats
+		case done := <-c.cacheClearChan:
+			c.generation++
+			c.pendingMisses = make(map[string]*pendingMiss) // Later requests don't join older misses.
+			c.cacheOpChan <- &cacheOp{opClear, "", nil, nil, Validators{}, nil, 0, 0, 0, time.Time{}, fileStamp{}, nil}
+			done <- true
+		case <-c.cacheCloseChan:
+			mapOpCloseChan <- true
+			<-mapOpCloseChan
+			c.cacheCloseChan <- false
+			return
+		}
+	}
+}
@@ -0,0 +1,644 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+ *	Builds a cache that reads "<dir>:<name>" for every file and counts its reads.
+ */
+func newTestCache(dir string, capacity int, reads *uint64, t *testing.T) *Cache {
+	c, err := New(Options{
+		Capacity: capacity,
+		Timeout:  time.Second,
+		Dir:      dir,
+		ReadFile: func(ctx context.Context, dir, name string) ([]byte, error) {
+			atomic.AddUint64(reads, 1)
+			return []byte(dir + ":" + name), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func validateGet(c *Cache, name string, expected []byte, hit bool, t *testing.T) (failed bool) {
+	file, err := c.Get(context.Background(), name)
+	if err != nil {
+		t.Errorf("Could not get (%s): %v", name, err)
+		return true
+	}
+	if !bytes.Equal(file.Data, expected) {
+		failed = true
+		t.Errorf("Got the wrong data for (%s)! Expected: (%s), Actual: (%s)", name, expected, file.Data)
+	}
+	if file.Hit != hit {
+		failed = true
+		t.Errorf("Wrong cache status for (%s)! Expected hit: (%v), Actual: (%v)", name, hit, file.Hit)
+	}
+	return failed
+}
+
+// ============ Cache Instance Tests ============
+
+func TestCacheUnknownEviction(t *testing.T) {
+	if _, err := New(Options{Capacity: 10, Timeout: time.Second, Eviction: "fifo"}); err == nil {
+		t.Errorf("New should have refused an unknown eviction policy!")
+	}
+}
+
+func TestCacheIndependentInstances(t *testing.T) {
+	var readsA, readsB uint64
+	a := newTestCache("a", 100, &readsA, t)
+	defer a.Close()
+	b := newTestCache("b", 100, &readsB, t)
+	defer b.Close()
+
+	validateGet(a, "./x", []byte("a:./x"), false, t)
+	validateGet(a, "./x", []byte("a:./x"), true, t)
+	validateGet(b, "./x", []byte("b:./x"), false, t)
+	if readsA != 1 || readsB != 1 {
+		t.Errorf("Every cache should have read the file once! Actual: (%v, %v)", readsA, readsB)
+	}
+
+	a.Clear()
+	if stats := a.Stats(); stats.Items != 0 || stats.Hits != 1 || stats.Misses != 1 {
+		t.Errorf("Wrong stats after a clear! Expected: (0 items, 1 hit, 1 miss), Actual: (%v items, %v hits, %v misses)",
+			stats.Items, stats.Hits, stats.Misses)
+	}
+	if stats := b.Stats(); stats.Items != 1 || stats.BytesUsed != 5 {
+		t.Errorf("Clearing one cache changed another! Expected: (1 item, 5 bytes), Actual: (%v items, %v bytes)",
+			stats.Items, stats.BytesUsed)
+	}
+	validateGet(b, "./x", []byte("b:./x"), true, t)
+}
+
+func TestCacheCoalescesMisses(t *testing.T) {
+	var reads uint64
+	release := make(chan bool)
+	c, err := New(Options{
+		Capacity: 100,
+		Timeout:  5 * time.Second,
+		ReadFile: func(ctx context.Context, dir, name string) ([]byte, error) {
+			atomic.AddUint64(&reads, 1)
+			<-release
+			return []byte(name), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if file, err := c.Get(context.Background(), "./slow"); err != nil || string(file.Data) != "./slow" {
+				t.Errorf("Got the wrong file: (%v, %v)", file, err)
+			}
+		}()
+	}
+	for c.Stats().Misses != 20 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	if reads != 1 {
+		t.Errorf("Concurrent misses should share one read! Actual reads: (%v)", reads)
+	}
+}
+
+func TestCacheErrors(t *testing.T) {
+	readErr := errors.New("no such file")
+	c, err := New(Options{
+		Capacity: 100,
+		Timeout:  100 * time.Millisecond,
+		ReadFile: func(ctx context.Context, dir, name string) ([]byte, error) {
+			if name == "./slow" {
+				time.Sleep(300 * time.Millisecond)
+				return []byte("slow"), nil
+			}
+			return nil, readErr
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(context.Background(), "./missing"); err != readErr {
+		t.Errorf("Expected the read error! Actual: (%v)", err)
+	}
+	if _, err := c.Get(context.Background(), "./slow"); err != ErrTimeout {
+		t.Errorf("Expected a timeout! Actual: (%v)", err)
+	}
+	stats := c.Stats()
+	if stats.FileErrors != 1 || stats.Timeouts != 1 {
+		t.Errorf("Wrong error counters! Expected: (1 file error, 1 timeout), Actual: (%v, %v)",
+			stats.FileErrors, stats.Timeouts)
+	}
+
+	c.Close()
+	c.Close() // Closing twice is fine.
+	if _, err := c.Get(context.Background(), "./missing"); err != ErrClosed {
+		t.Errorf("Expected ErrClosed from a closed cache! Actual: (%v)", err)
+	}
+	if stats := c.Stats(); stats.FileErrors != 1 {
+		t.Errorf("A closed cache lost its counters! Actual file errors: (%v)", stats.FileErrors)
+	}
+}
+
+func TestCacheShutdown(t *testing.T) {
+	release := make(chan bool)
+	c, err := New(Options{
+		Capacity: 100,
+		Timeout:  time.Millisecond * 10,
+		ReadFile: func(ctx context.Context, dir, name string) ([]byte, error) {
+			if name == "./stuck" {
+				<-release // Ignores the context, like userlib.ReadFile.
+				return nil, errors.New("released")
+			}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both reads time out and are left running in the background.
+	for _, name := range []string{"./slow", "./stuck"} {
+		if _, err := c.Get(context.Background(), name); err != ErrTimeout {
+			t.Errorf("Expected a timeout for (%s)! Actual: (%v)", name, err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown should have given up on the stuck read! Actual: (%v)", err)
+	}
+	if _, err := c.Get(context.Background(), "./slow"); err != ErrClosed {
+		t.Errorf("Expected ErrClosed after a shutdown! Actual: (%v)", err)
+	}
+	close(release)
+	if err := c.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown should have waited for every read! Actual: (%v)", err)
+	}
+}
+
+func TestCacheNeverExceedsCapacity(t *testing.T) {
+	var reads uint64
+	c := newTestCache("", 20, &reads, t)
+	defer c.Close()
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("./%v", i%13) // Between 4 and 5 bytes of data.
+		if _, err := c.Get(context.Background(), name); err != nil {
+			t.Fatal(err)
+		}
+		if stats := c.Stats(); stats.BytesUsed > stats.Capacity {
+			t.Fatalf("The capacity of the cache has been exceeded! Expected max: (%v), Actual: (%v)",
+				stats.Capacity, stats.BytesUsed)
+		}
+	}
+	if stats := c.Stats(); stats.Evictions == 0 {
+		t.Errorf("The cache should have evicted files to make room!")
+	}
+}
+
+func TestCacheResize(t *testing.T) {
+	var reads uint64
+	c, err := New(Options{
+		Capacity: 100,
+		Timeout:  time.Second,
+		Eviction: "lru",
+		ReadFile: func(ctx context.Context, dir, name string) ([]byte, error) {
+			atomic.AddUint64(&reads, 1)
+			if name == "./slow" {
+				time.Sleep(time.Millisecond * 100)
+			}
+			return []byte(name + "...."), nil // 7 bytes for './x'.
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, name := range []string{"./a", "./b", "./c", "./d"} {
+		validateGet(c, name, []byte(name+"...."), false, t)
+	}
+	validateGet(c, "./a", []byte("./a...."), true, t) // './b' is now the least recently used.
+	if removed := c.Resize(1000); len(removed) != 0 || c.Capacity() != 1000 {
+		t.Errorf("Growing the cache should not evict anything! Actual: (%v removed, capacity %v)", len(removed), c.Capacity())
+	}
+	removed := c.Resize(14)
+	if len(removed) != 2 || removed[0].Name != "./b" || removed[1].Name != "./c" {
+		t.Errorf("Shrinking should evict in LRU order! Expected: (./b, ./c), Actual: (%v)", removed)
+	}
+	stats := c.Stats()
+	if stats.Items != 2 || stats.BytesUsed != 14 || stats.Capacity != 14 || stats.Evictions != 2 {
+		t.Errorf("Wrong stats after a resize! Expected: (2 items, 14 bytes, capacity 14, 2 evictions), Actual: (%v, %v, %v, %v)",
+			stats.Items, stats.BytesUsed, stats.Capacity, stats.Evictions)
+	}
+	validateGet(c, "./a", []byte("./a...."), true, t)
+	validateGet(c, "./d", []byte("./d...."), true, t)
+	if removed := c.Resize(-5); len(removed) != 2 || c.Capacity() != 0 {
+		t.Errorf("A negative capacity should empty the cache! Actual: (%v removed, capacity %v)", len(removed), c.Capacity())
+	}
+	validateGet(c, "./a", []byte("./a...."), false, t) // Nothing fits anymore.
+	validateGet(c, "./a", []byte("./a...."), false, t)
+
+	c.SetTimeout(time.Millisecond * 10)
+	if _, err := c.Get(context.Background(), "./slow"); err != ErrTimeout {
+		t.Errorf("The new timeout was not used! Actual: (%v)", err)
+	}
+}
+
+func TestCacheAbandonedMiss(t *testing.T) {
+	started := make(chan bool, 2)
+	canceled := make(chan bool, 2)
+	c, err := New(Options{
+		Capacity: 100,
+		Timeout:  5 * time.Second,
+		ReadFile: func(ctx context.Context, dir, name string) ([]byte, error) {
+			started <- true
+			select {
+			case <-ctx.Done():
+				canceled <- true
+				return nil, ctx.Err()
+			case <-time.After(300 * time.Millisecond):
+				return []byte(name), nil
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// One of two requests gives up, the other one keeps the read going.
+	ctx, cancel := context.WithCancel(context.Background())
+	gaveUp := make(chan error)
+	go func() {
+		_, err := c.Get(ctx, "./shared")
+		gaveUp <- err
+	}()
+	<-started
+	waited := make(chan *File)
+	go func() {
+		file, _ := c.Get(context.Background(), "./shared")
+		waited <- file
+	}()
+	for c.Stats().Misses != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-gaveUp; err != context.Canceled {
+		t.Errorf("Expected the context's error! Actual: (%v)", err)
+	}
+	if file := <-waited; file == nil || string(file.Data) != "./shared" {
+		t.Errorf("The request still waiting on the read did not get the file: (%v)", file)
+	}
+
+	// Once every request gave up, the read gets canceled.
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.Get(ctx, "./alone"); err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to pass! Actual: (%v)", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Errorf("The read was not canceled when nobody waited on it anymore!")
+	}
+	if stats := c.Stats(); stats.Items != 1 || stats.InFlightMisses != 0 || stats.FileErrors != 0 {
+		t.Errorf("Wrong stats! Expected: (1 item, 0 in-flight misses, 0 file errors), Actual: (%v, %v, %v)",
+			stats.Items, stats.InFlightMisses, stats.FileErrors)
+	}
+}
+
+func TestCacheReadFileContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := bytes.Repeat([]byte("CS61C"), readChunkSize)
+	if err := ioutil.WriteFile(dir+"/file", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if read, err := ReadFile(context.Background(), dir, "/file"); err != nil || !bytes.Equal(read, data) {
+		t.Errorf("Could not read the file back! Error: (%v)", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ReadFile(ctx, dir, "/file"); err != context.Canceled {
+		t.Errorf("Expected a canceled read! Actual: (%v)", err)
+	}
+	if _, err := ReadFile(context.Background(), dir, "/missing"); err == nil {
+		t.Errorf("Reading a missing file should have failed!")
+	}
+}
+
+func TestCacheClearDropsStaleMiss(t *testing.T) {
+	var reads uint64
+	release := make(chan bool)
+	c, err := New(Options{
+		Capacity: 100,
+		Timeout:  5 * time.Second,
+		ReadFile: func(ctx context.Context, dir, name string) ([]byte, error) {
+			if atomic.AddUint64(&reads, 1) == 1 {
+				<-release
+				return []byte("stale"), nil
+			}
+			return []byte("fresh"), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	stale := make(chan *File)
+	go func() {
+		file, _ := c.Get(context.Background(), "./file")
+		stale <- file
+	}()
+	for c.Stats().InFlightMisses != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Clear()
+	// A request after the clear does NOT join the older miss.
+	validateGet(c, "./file", []byte("fresh"), false, t)
+	close(release)
+	if file := <-stale; file == nil || string(file.Data) != "stale" {
+		t.Errorf("The request waiting across the clear did not get its file: (%v)", file)
+	}
+	validateGet(c, "./file", []byte("fresh"), true, t)
+	if reads != 2 {
+		t.Errorf("Expected one read per generation! Actual reads: (%v)", reads)
+	}
+}
+
+func TestCacheConcurrentClears(t *testing.T) {
+	var reads uint64
+	c := newTestCache("", 50, &reads, t)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				c.Clear()
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				name := fmt.Sprintf("./%v", (i+j)%17)
+				if file, err := c.Get(context.Background(), name); err != nil || string(file.Data) != ":"+name {
+					t.Errorf("Got the wrong file: (%v, %v)", file, err)
+					return
+				}
+				c.Invalidate(name)
+				c.Evict(name)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if stats := c.Stats(); stats.BytesUsed > stats.Capacity || stats.InFlightMisses != 0 {
+		t.Errorf("Wrong stats after the clears! Actual: (%v/%v bytes, %v in-flight misses)",
+			stats.BytesUsed, stats.Capacity, stats.InFlightMisses)
+	}
+	// Clearing while closing is fine too.
+	go c.Clear()
+	c.Close()
+	c.Clear()
+}
+
+/*
+ *	Builds a cache over a real dir (revalidation stats the files) with the given expiration
+ *	options. Reads fail while *failing is set.
+ */
+func newExpiringCache(dir string, options Options, reads *uint64, failing *int32, t *testing.T) *Cache {
+	options.Capacity = 100
+	options.Timeout = time.Second
+	options.Dir = dir
+	options.ReadFile = func(ctx context.Context, dir, name string) ([]byte, error) {
+		atomic.AddUint64(reads, 1)
+		if atomic.LoadInt32(failing) != 0 {
+			return nil, errors.New("disk failure")
+		}
+		return ioutil.ReadFile(dir + name)
+	}
+	c, err := New(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+/*
+ *	Rewrites a file and moves its mod time forward, so it looks changed even on coarse clocks.
+ */
+func rewriteFile(filename, content string, t *testing.T) {
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filename, later, later); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitForMisses(c *Cache) {
+	for c.Stats().InFlightMisses != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	dir := t.TempDir()
+	rewriteFile(dir+"/f", "one", t)
+	var reads uint64
+	var failing int32
+	ttl := time.Millisecond * 50
+	c := newExpiringCache(dir, Options{TTL: func(string) time.Duration { return ttl },
+		StaleWhileRevalidate: time.Hour}, &reads, &failing, t)
+	defer c.Close()
+
+	validateGet(c, "/f", []byte("one"), false, t)
+	validateGet(c, "/f", []byte("one"), true, t)
+	time.Sleep(ttl)
+	// Expired: served stale, and revalidated without a read since the file did not change.
+	if file, err := c.Get(context.Background(), "/f"); err != nil || !file.Hit || !file.Stale {
+		t.Errorf("An expired file should be served stale! Actual: (%+v, %v)", file, err)
+	}
+	waitForMisses(c)
+	if file, err := c.Get(context.Background(), "/f"); err != nil || !file.Hit || file.Stale {
+		t.Errorf("A revalidated file should be fresh again! Actual: (%+v, %v)", file, err)
+	}
+	if reads != 1 {
+		t.Errorf("An unchanged file should not be read again! Expected reads: (1), Actual: (%v)", reads)
+	}
+
+	// Changed on disk: still served stale once, then the new content is cached.
+	rewriteFile(dir+"/f", "two!", t)
+	time.Sleep(ttl)
+	validateGet(c, "/f", []byte("one"), true, t)
+	waitForMisses(c)
+	validateGet(c, "/f", []byte("two!"), true, t)
+	if stats := c.Stats(); reads != 2 || stats.StaleHits != 2 || stats.Items != 1 || stats.BytesUsed != 4 {
+		t.Errorf("Wrong stats after the revalidations! Expected: (2 reads, 2 stale hits, 1 item, 4 bytes), "+
+			"Actual: (%v, %v, %v, %v)", reads, stats.StaleHits, stats.Items, stats.BytesUsed)
+	}
+
+	// GetCached serves an expired file stale too, but never revalidates it.
+	time.Sleep(ttl)
+	for i := 0; i < 2; i++ {
+		if file := c.GetCached("/f"); file == nil || !file.Stale || string(file.Data) != "two!" {
+			t.Errorf("GetCached should serve the expired file stale! Actual: (%+v)", file)
+		}
+		waitForMisses(c)
+	}
+
+	// Past the stale window, an expired file is a miss (revalidated before answering).
+	d := newExpiringCache(dir, Options{TTL: func(string) time.Duration { return ttl }}, &reads, &failing, t)
+	defer d.Close()
+	validateGet(d, "/f", []byte("two!"), false, t)
+	time.Sleep(ttl)
+	if file, err := d.Get(context.Background(), "/f"); err != nil || file.Hit || file.Stale || string(file.Data) != "two!" {
+		t.Errorf("An expired file without a stale window should be a miss! Actual: (%+v, %v)", file, err)
+	}
+	if reads != 3 {
+		t.Errorf("An unchanged file should not be read again! Expected reads: (3), Actual: (%v)", reads)
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	dir := t.TempDir()
+	rewriteFile(dir+"/f", "one", t)
+	var reads uint64
+	var failing int32
+	ttl := time.Millisecond * 50
+	c := newExpiringCache(dir, Options{TTL: func(string) time.Duration { return ttl },
+		StaleIfError: time.Hour}, &reads, &failing, t)
+	defer c.Close()
+	d := newExpiringCache(dir, Options{TTL: func(string) time.Duration { return ttl }}, &reads, &failing, t)
+	defer d.Close()
+
+	validateGet(c, "/f", []byte("one"), false, t)
+	validateGet(d, "/f", []byte("one"), false, t)
+	rewriteFile(dir+"/f", "two!", t)
+	atomic.StoreInt32(&failing, 1)
+	time.Sleep(ttl)
+	if file, err := c.Get(context.Background(), "/f"); err != nil || !file.Stale || string(file.Data) != "one" {
+		t.Errorf("A failed read should serve the last good copy! Actual: (%+v, %v)", file, err)
+	}
+	if stats := c.Stats(); stats.FileErrors != 1 || stats.StaleHits != 1 || stats.Items != 1 {
+		t.Errorf("Wrong stats after a stale-if-error! Expected: (1 file error, 1 stale hit, 1 item), Actual: (%v, %v, %v)",
+			stats.FileErrors, stats.StaleHits, stats.Items)
+	}
+	// Without a stale-if-error window, the error goes through.
+	if _, err := d.Get(context.Background(), "/f"); err == nil {
+		t.Errorf("A failed read without a stale-if-error window should fail!")
+	}
+	// Once the disk is back, the new content is read.
+	atomic.StoreInt32(&failing, 0)
+	validateGet(c, "/f", []byte("two!"), false, t)
+	validateGet(c, "/f", []byte("two!"), true, t)
+}
+
+func TestCacheTooLarge(t *testing.T) {
+	dir := t.TempDir()
+	rewriteFile(dir+"/small", "tiny", t)
+	rewriteFile(dir+"/large", "not so tiny", t)
+	rewriteFile(dir+"/huge", "far too large for the cache", t)
+	var reads uint64
+	var failing int32
+	c := newExpiringCache(dir, Options{MaxFileSize: 10, LimitToCapacity: true}, &reads, &failing, t)
+	defer c.Close()
+	c.Resize(20)
+
+	validateGet(c, "/small", []byte("tiny"), false, t)
+	for _, name := range []string{"/large", "/huge"} {
+		if file, err := c.Get(context.Background(), name); err != ErrTooLarge {
+			t.Errorf("A file over the limit should not be read! Actual: (%v, %v)", file, err)
+		}
+	}
+	// Files that can't be found (size unknown) are read like any other.
+	if _, err := c.Get(context.Background(), "/missing"); err == nil || err == ErrTooLarge {
+		t.Errorf("A missing file should be a file error! Actual: (%v)", err)
+	}
+	if stats := c.Stats(); reads != 2 || stats.TooLarge != 2 || stats.FileErrors != 1 {
+		t.Errorf("Wrong stats! Expected: (2 reads, 2 too large, 1 file error), Actual: (%v, %v, %v)",
+			reads, stats.TooLarge, stats.FileErrors)
+	}
+	// Limited by the capacity only.
+	d := newExpiringCache(dir, Options{LimitToCapacity: true}, &reads, &failing, t)
+	defer d.Close()
+	d.Resize(20)
+	validateGet(d, "/large", []byte("not so tiny"), false, t)
+	if _, err := d.Get(context.Background(), "/huge"); err != ErrTooLarge {
+		t.Errorf("A file bigger than the capacity should not be read! Actual: (%v)", err)
+	}
+}
+
+func TestCacheVariants(t *testing.T) {
+	var reads uint64
+	c, err := New(Options{
+		Capacity: 100,
+		Timeout:  time.Second,
+		ReadFile: func(ctx context.Context, dir, name string) ([]byte, error) {
+			atomic.AddUint64(&reads, 1)
+			return []byte(name), nil
+		},
+		ReadVariant: func(ctx context.Context, dir, name, variant string) ([]byte, error) {
+			atomic.AddUint64(&reads, 1)
+			if variant == "none" {
+				return nil, nil
+			}
+			return []byte(variant + ":" + name), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	validateGet(c, "./a", []byte("./a"), false, t)
+	for i := 0; i < 2; i++ {
+		file, err := c.GetVariant(context.Background(), "./a", "gzip")
+		if err != nil || file.Name != "./a" || file.Variant != "gzip" || string(file.Data) != "gzip:./a" {
+			t.Errorf("Got the wrong variant: (%v, %v)", file, err)
+		}
+		if file, err := c.GetVariant(context.Background(), "./a", "none"); err != nil || len(file.Data) != 0 {
+			t.Errorf("A missing variant should be empty: (%v, %v)", file, err)
+		}
+	}
+	if reads != 3 {
+		t.Errorf("Variants should be cached! Expected reads: (3), Actual: (%v)", reads)
+	}
+	stats := c.StatsTop(1)
+	if stats.Items != 3 || stats.BytesUsed != len("./a")+len("gzip:./a") {
+		t.Errorf("Wrong cache usage! Expected: (3 items, %v bytes), Actual: (%v items, %v bytes)",
+			len("./a")+len("gzip:./a"), stats.Items, stats.BytesUsed)
+	}
+	if len(stats.TopKeys) != 1 || stats.TopKeys[0] != (KeyHits{"./a", "gzip", 1}) {
+		t.Errorf("Wrong top keys! Actual: (%v)", stats.TopKeys)
+	}
+	removed := c.Evict("./a")
+	if len(removed) != 3 || removed[0].Variant != "" || removed[1].Variant != "gzip" || removed[2].Variant != "none" {
+		t.Errorf("Evicting a file should evict its variants (sorted)! Actual: (%v)", removed)
+	}
+}
+
+// ============ End of Cache Instance Tests ============
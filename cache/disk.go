@@ -0,0 +1,364 @@
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * The second tier of a cache, on the local disk (see Options.DiskDir). The data is kept
+ * in content-addressed blobs (named after the ETag hash, so files with the same content
+ * share one), listed by an index file that is saved every diskSaveInterval and on close.
+ * Each entry remembers the mod time and size of the file it was read from, so a copy
+ * is never served once the file changed. It has its own capacity, the least recently
+ * used entries go first. Safe for concurrent use.
+ */
+type diskTier struct {
+	dir      string
+	capacity int64
+	mutex    sync.Mutex
+	entries  map[string]*diskEntry // By cache key.
+	blobs    map[string]int        // Number of entries using each blob.
+	used     int64                 // Bytes of all blobs (each one counted once).
+	hits     uint64                // Misses served from the tier, changed atomically.
+	clears   uint64                // Number of clears (see clear), changed atomically with the mutex held.
+	dirty    bool                  // The index changed since it was saved.
+	stop     chan bool
+	stopped  chan bool
+}
+
+/**
+ * An index entry, the stamp and validators are those of the file when it was read.
+ */
+type diskEntry struct {
+	Name    string    `json:"name"`
+	Blob    string    `json:"blob"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	ETag    string    `json:"etag"`
+	Hits    int       `json:"hits"` // Cache hits (in memory) and loads since it was first stored.
+	Used    time.Time `json:"used"` // Last stored or loaded.
+}
+
+const (
+	diskIndexFile    = "index.json"
+	diskBlobDir      = "blobs"
+	diskSaveInterval = time.Second
+)
+
+/**
+ * Opens (or starts) the tier in dir. Entries whose blob is gone are dropped, and so are
+ * the blobs that no entry uses (e.g. the leftovers of a crash).
+ */
+func openDiskTier(dir string, capacity int64) (*diskTier, error) {
+	if err := os.MkdirAll(filepath.Join(dir, diskBlobDir), 0700); err != nil {
+		return nil, err
+	}
+	d := &diskTier{dir, capacity, sync.Mutex{}, make(map[string]*diskEntry), make(map[string]int),
+		0, 0, 0, false, make(chan bool), make(chan bool)}
+	var index []*diskEntry
+	if data, err := ioutil.ReadFile(filepath.Join(dir, diskIndexFile)); err == nil {
+		if err := json.Unmarshal(data, &index); err != nil {
+			index = nil // A broken index starts the tier over.
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range index {
+		info, err := os.Stat(d.blobPath(entry.Blob))
+		if err != nil || info.Size() != entry.Size || d.entries[entry.Name] != nil {
+			d.dirty = true
+			continue
+		}
+		d.add(entry)
+	}
+	blobs, err := ioutil.ReadDir(filepath.Join(dir, diskBlobDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, blob := range blobs {
+		if _, ok := d.blobs[blob.Name()]; !ok {
+			_ = os.Remove(d.blobPath(blob.Name()))
+		}
+	}
+	d.evictUntil(d.capacity, nil) // The capacity may have shrunk since.
+	go d.saveLoop()
+	return d, nil
+}
+
+func (d *diskTier) blobPath(blob string) string {
+	return filepath.Join(d.dir, diskBlobDir, blob)
+}
+
+/**
+ * Adds an entry whose blob is on disk. The mutex must be held (or not shared yet).
+ */
+func (d *diskTier) add(entry *diskEntry) {
+	if d.blobs[entry.Blob] == 0 {
+		d.used += entry.Size
+	}
+	d.blobs[entry.Blob]++
+	d.entries[entry.Name] = entry
+	d.dirty = true
+}
+
+/**
+ * Drops an entry, and its blob if no other entry uses it. The mutex must be held.
+ */
+func (d *diskTier) remove(entry *diskEntry) {
+	delete(d.entries, entry.Name)
+	if d.blobs[entry.Blob]--; d.blobs[entry.Blob] <= 0 {
+		delete(d.blobs, entry.Blob)
+		d.used -= entry.Size
+		_ = os.Remove(d.blobPath(entry.Blob))
+	}
+	d.dirty = true
+}
+
+/**
+ * Drops the least recently used entries (but keep) until the blobs fit in limit. The
+ * mutex must be held.
+ */
+func (d *diskTier) evictUntil(limit int64, keep *diskEntry) {
+	if d.used <= limit {
+		return
+	}
+	entries := make([]*diskEntry, 0, len(d.entries))
+	for _, entry := range d.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Used.Before(entries[j].Used)
+	})
+	for _, entry := range entries {
+		if d.used <= limit {
+			break
+		}
+		if entry != keep {
+			d.remove(entry)
+		}
+	}
+}
+
+/**
+ * Stores a file evicted from memory. The hits (in memory) add up with those it had on
+ * disk. Files bigger than the whole tier are not stored, and neither are the ones that
+ * left the memory before the last clear (clears is the count when they did).
+ */
+func (d *diskTier) store(key string, data []byte, validators Validators, stamp fileStamp, hits int, clears uint64) error {
+	size := int64(len(data))
+	if size > d.capacity || stamp.size != size {
+		return nil
+	}
+	blob := strings.Trim(validators.ETag, "\"")
+	d.mutex.Lock()
+	_, exists := d.blobs[blob]
+	d.mutex.Unlock()
+	if !exists {
+		if err := d.writeBlob(blob, data); err != nil {
+			return err
+		}
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if clears != atomic.LoadUint64(&d.clears) {
+		if _, ok := d.blobs[blob]; !ok {
+			_ = os.Remove(d.blobPath(blob))
+		}
+		return nil
+	}
+	if old, ok := d.entries[key]; ok {
+		if old.Blob == blob && old.ModTime.Equal(stamp.modTime) {
+			old.Hits += hits
+			old.Used = time.Now()
+			d.dirty = true
+			return nil
+		}
+		d.remove(old)
+	}
+	if _, ok := d.blobs[blob]; !ok {
+		// Written above, or by a concurrent store. A removal may have raced the write, so
+		// it is written again if needed (same content, so a rename over it is harmless).
+		if _, err := os.Stat(d.blobPath(blob)); err != nil {
+			if err := d.writeBlob(blob, data); err != nil {
+				return err
+			}
+		}
+	}
+	// Added before evicting, so its blob (which other entries may share) stays.
+	entry := &diskEntry{key, blob, size, stamp.modTime, validators.ETag, hits, time.Now()}
+	d.add(entry)
+	d.evictUntil(d.capacity, entry)
+	return nil
+}
+
+/**
+ * Writes a blob through a temporary file, so a blob on disk is always complete.
+ */
+func (d *diskTier) writeBlob(blob string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Join(d.dir, diskBlobDir), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.blobPath(blob))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+/**
+ * Finds the copy of a file that was read at the given stamp, a copy of an older version
+ * is dropped. Returns the entry's blob path (empty if there is no such copy), size and
+ * validators.
+ */
+func (d *diskTier) lookup(key string, stamp fileStamp) (string, int64, Validators) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	entry, ok := d.entries[key]
+	if !ok {
+		return "", 0, Validators{}
+	}
+	if !stamp.known() || !stamp.equal(fileStamp{entry.ModTime, entry.Size}) {
+		d.remove(entry) // The file changed (or is gone).
+		return "", 0, Validators{}
+	}
+	entry.Hits++
+	entry.Used = time.Now()
+	d.dirty = true
+	return d.blobPath(entry.Blob), entry.Size, Validators{entry.ETag, entry.ModTime}
+}
+
+/**
+ * Drops the copy of a file (and of every file under the prefix, with prefix set).
+ */
+func (d *diskTier) drop(name string, prefix bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for key, entry := range d.entries {
+		if key == name || (prefix && strings.HasPrefix(key, name)) {
+			d.remove(entry)
+		}
+	}
+}
+
+/**
+ * Drops every entry (see Cache.Clear). The files that left the memory before the clear
+ * and are still on their way to the tier are not stored (see store).
+ */
+func (d *diskTier) clear() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, entry := range d.entries {
+		d.remove(entry)
+	}
+	atomic.AddUint64(&d.clears, 1)
+}
+
+/**
+ * The names of the most hit entries whose sizes add up to at most limit bytes.
+ */
+func (d *diskTier) hottest(limit int64) []string {
+	d.mutex.Lock()
+	entries := make([]diskEntry, 0, len(d.entries))
+	for _, entry := range d.entries {
+		entries = append(entries, *entry)
+	}
+	d.mutex.Unlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Hits == entries[j].Hits {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Hits > entries[j].Hits
+	})
+	names := []string{}
+	for _, entry := range entries {
+		if entry.Size <= limit {
+			names = append(names, entry.Name)
+			limit -= entry.Size
+		}
+	}
+	return names
+}
+
+/**
+ * Fills in the tier's part of the stats.
+ */
+func (d *diskTier) fillStats(stats *Stats) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	stats.DiskItems = len(d.entries)
+	stats.DiskBytesUsed = d.used
+	stats.DiskCapacity = d.capacity
+	stats.DiskHits = atomic.LoadUint64(&d.hits)
+}
+
+/**
+ * Saves the index (if it changed) through a temporary file.
+ */
+func (d *diskTier) save() error {
+	d.mutex.Lock()
+	if !d.dirty {
+		d.mutex.Unlock()
+		return nil
+	}
+	index := make([]*diskEntry, 0, len(d.entries))
+	for _, entry := range d.entries {
+		copied := *entry
+		index = append(index, &copied)
+	}
+	d.dirty = false
+	d.mutex.Unlock()
+	sort.Slice(index, func(i, j int) bool {
+		return index[i].Name < index[j].Name
+	})
+	data, err := json.Marshal(index)
+	if err == nil {
+		tmp := filepath.Join(d.dir, diskIndexFile+".tmp")
+		if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, filepath.Join(d.dir, diskIndexFile))
+		}
+	}
+	if err != nil {
+		d.mutex.Lock()
+		d.dirty = true // Try again on the next save.
+		d.mutex.Unlock()
+	}
+	return err
+}
+
+func (d *diskTier) saveLoop() {
+	ticker := time.NewTicker(diskSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = d.save()
+		case <-d.stop:
+			d.stopped <- true
+			return
+		}
+	}
+}
+
+/**
+ * Stops the background saves and saves the index one last time.
+ */
+func (d *diskTier) close() error {
+	d.stop <- true
+	<-d.stopped
+	return d.save()
+}
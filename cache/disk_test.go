@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ *	Builds a cache over dir with a disk tier in diskDir, counting its reads.
+ */
+func newDiskCache(dir, diskDir string, diskCapacity int64, reads *uint64, t *testing.T) *Cache {
+	var failing int32
+	return newExpiringCache(dir, Options{DiskDir: diskDir, DiskCapacity: diskCapacity}, reads, &failing, t)
+}
+
+/*
+ *	Waits for the files that left the memory to be written to the disk tier. The stats
+ *	request is handled after any earlier eviction or clear, so their writes have started.
+ */
+func waitForDiskWrites(c *Cache) {
+	c.Stats()
+	c.diskWrites.Wait()
+}
+
+/*
+ *	Evicts every file from memory (a clear would empty the disk tier too), they drop to
+ *	the disk tier.
+ */
+func spillAll(c *Cache) {
+	capacity := c.Capacity()
+	ReleaseFiles(c.Resize(0))
+	c.Resize(capacity)
+	waitForDiskWrites(c)
+}
+
+func validateDiskStats(c *Cache, items int, bytesUsed int64, hits uint64, t *testing.T) {
+	waitForDiskWrites(c)
+	stats := c.Stats()
+	if stats.DiskItems != items || stats.DiskBytesUsed != bytesUsed || stats.DiskHits != hits {
+		t.Errorf("Wrong disk stats! Expected: (%v items, %v bytes, %v hits), Actual: (%v, %v, %v)",
+			items, bytesUsed, hits, stats.DiskItems, stats.DiskBytesUsed, stats.DiskHits)
+	}
+}
+
+func TestCacheDiskTier(t *testing.T) {
+	dir, diskDir := t.TempDir(), t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		rewriteFile(dir+"/"+name, strings.Repeat(name, 40), t)
+	}
+	var reads uint64
+	c := newDiskCache(dir, diskDir, 1000, &reads, t)
+	defer c.Close()
+
+	// The third file evicts one of the others, which drops to the disk.
+	for _, name := range []string{"/a", "/b", "/c"} {
+		validateGet(c, name, []byte(strings.Repeat(name[1:], 40)), false, t)
+	}
+	validateDiskStats(c, 1, 40, 0, t)
+	spillAll(c)
+	validateDiskStats(c, 3, 120, 0, t)
+	for _, name := range []string{"/a", "/b", "/c"} {
+		validateGet(c, name, []byte(strings.Repeat(name[1:], 40)), false, t)
+	}
+	if reads != 3 {
+		t.Errorf("The misses should have been served by the disk tier! Actual reads: (%v)", reads)
+	}
+	validateDiskStats(c, 3, 120, 3, t)
+
+	// A file that changed is read again, an evicted one is gone from the disk too.
+	spillAll(c)
+	rewriteFile(dir+"/a", "changed", t)
+	validateGet(c, "/a", []byte("changed"), false, t)
+	c.Evict("/b")
+	validateGet(c, "/b", []byte(strings.Repeat("b", 40)), false, t)
+	if reads != 5 {
+		t.Errorf("The changed and the evicted files should have been read! Actual reads: (%v)", reads)
+	}
+	validateDiskStats(c, 1, 40, 3, t)
+
+	// A clear empties both tiers, nothing comes back from the disk.
+	c.Clear()
+	validateDiskStats(c, 0, 0, 3, t)
+	validateGet(c, "/c", []byte(strings.Repeat("c", 40)), false, t)
+	if reads != 6 {
+		t.Errorf("The cleared file should have been read again! Actual reads: (%v)", reads)
+	}
+}
+
+func TestCacheDiskTierRestart(t *testing.T) {
+	dir, diskDir := t.TempDir(), t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		rewriteFile(dir+"/"+name, strings.Repeat(name, 40), t)
+	}
+	var reads uint64
+	c := newDiskCache(dir, diskDir, 1000, &reads, t)
+	// Hits make "/c" and "/b" the hottest files, only two of them fit in memory.
+	names := []string{"/a", "/b", "/b", "/b", "/c", "/c", "/c", "/c"}
+	hits := []bool{false, false, true, true, false, true, true, true}
+	for i, name := range names {
+		validateGet(c, name, []byte(strings.Repeat(name[1:], 40)), hits[i], t)
+	}
+	spillAll(c)
+	validateGet(c, "/a", []byte(strings.Repeat("a", 40)), false, t)
+	c.Close() // Saves what is still cached ("/a") along with the index.
+	if stats := c.Stats(); stats.DiskItems != 3 {
+		t.Errorf("Every file should be on the disk after the close! Actual: (%v items)", stats.DiskItems)
+	}
+	leftover := filepath.Join(diskDir, diskBlobDir, "leftover")
+	if err := ioutil.WriteFile(leftover, []byte("crash"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reads = 0
+	c = newDiskCache(dir, diskDir, 1000, &reads, t)
+	defer c.Close()
+	for deadline := time.Now().Add(time.Second); c.Stats().Items < 2 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	validateGet(c, "/c", []byte(strings.Repeat("c", 40)), true, t)
+	validateGet(c, "/b", []byte(strings.Repeat("b", 40)), true, t)
+	if reads != 0 {
+		t.Errorf("The preloaded files should have come from the disk! Actual reads: (%v)", reads)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("A blob without an index entry should have been removed! Actual: (%v)", err)
+	}
+}
+
+func TestCacheDiskTierCapacity(t *testing.T) {
+	dir, diskDir := t.TempDir(), t.TempDir()
+	rewriteFile(dir+"/a", strings.Repeat("x", 40), t)
+	rewriteFile(dir+"/same", strings.Repeat("x", 40), t)
+	rewriteFile(dir+"/b", strings.Repeat("b", 40), t)
+	rewriteFile(dir+"/c", strings.Repeat("c", 40), t)
+	rewriteFile(dir+"/big", strings.Repeat("!", 90), t)
+	var reads uint64
+	c := newDiskCache(dir, diskDir, 100, &reads, t)
+	defer c.Close()
+
+	// Files with the same content share a blob.
+	validateGet(c, "/a", []byte(strings.Repeat("x", 40)), false, t)
+	validateGet(c, "/same", []byte(strings.Repeat("x", 40)), false, t)
+	spillAll(c)
+	validateDiskStats(c, 2, 40, 0, t)
+	// The least recently used go first: "/same" (its blob stays, "/a" still uses it).
+	validateGet(c, "/a", []byte(strings.Repeat("x", 40)), false, t)
+	time.Sleep(10 * time.Millisecond) // Apart on coarse clocks.
+	for _, name := range []string{"/b", "/c"} {
+		validateGet(c, name, []byte(strings.Repeat(name[1:], 40)), false, t)
+		spillAll(c)
+	}
+	validateDiskStats(c, 2, 80, 1, t)
+	if file, _ := c.Get(context.Background(), "/same"); file == nil || file.Hit || reads != 5 {
+		t.Errorf("The least recently used file should have left the disk! Actual reads: (%v)", reads)
+	}
+	// A big file pushes the others out, but never past the capacity.
+	spillAll(c)
+	validateGet(c, "/big", []byte(strings.Repeat("!", 90)), false, t)
+	spillAll(c)
+	if stats := c.Stats(); stats.DiskBytesUsed > 100 {
+		t.Errorf("The disk tier grew past its capacity! Actual: (%v bytes)", stats.DiskBytesUsed)
+	}
+}
+
+func TestCacheDiskTierSharedBlob(t *testing.T) {
+	dir, diskDir := t.TempDir(), t.TempDir()
+	rewriteFile(dir+"/a", strings.Repeat("x", 40), t)
+	rewriteFile(dir+"/same", strings.Repeat("x", 40), t)
+	rewriteFile(dir+"/b", strings.Repeat("b", 40), t)
+	var reads uint64
+	c := newDiskCache(dir, diskDir, 80, &reads, t)
+	defer c.Close()
+
+	for _, name := range []string{"/a", "/b"} {
+		content, _ := ioutil.ReadFile(dir + name)
+		validateGet(c, name, content, false, t)
+		spillAll(c)
+		time.Sleep(10 * time.Millisecond) // Apart on coarse clocks.
+	}
+	validateGet(c, "/b", []byte(strings.Repeat("b", 40)), false, t)
+	// The tier is full, "/a" is its least recently used entry and "/same" needs its blob.
+	validateGet(c, "/same", []byte(strings.Repeat("x", 40)), false, t)
+	spillAll(c)
+	validateDiskStats(c, 3, 80, 1, t)
+	for _, name := range []string{"/same", "/a"} {
+		validateGet(c, name, []byte(strings.Repeat("x", 40)), false, t)
+	}
+	if reads != 3 {
+		t.Errorf("The files sharing the blob should have come from the disk! Actual reads: (%v)", reads)
+	}
+}
+
+func TestCacheDiskTierBadDir(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Options{Capacity: 10, Timeout: time.Second, DiskDir: file, DiskCapacity: 10}); err == nil {
+		t.Errorf("New should have refused a disk tier that is not a directory!")
+	}
+}
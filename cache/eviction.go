@@ -0,0 +1,288 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/**
+ * An eviction policy decides which cache entry gets thrown out when the cache
+ * needs room. The map operator (mapOperator) is the only thread that touches
+ * a policy, so implementations do NOT need to be thread safe.
+ */
+type EvictionPolicy interface {
+	Insert(key string)             // Called once a key is added to the cache table.
+	Hit(key string)                // Called every time a cached key is read.
+	Remove(key string)             // Called once a key is deleted from the cache table.
+	Victim() (key string, ok bool) // Next key to evict, ok is false if nothing is tracked.
+}
+
+/**
+ * Constructors for all of the supported eviction policies (selected with Options.Eviction).
+ */
+var evictionPolicies = map[string]func() EvictionPolicy{
+	"random": func() EvictionPolicy { return newRandomPolicy() },
+	"lru":    func() EvictionPolicy { return newLRUPolicy() },
+	"lfu":    func() EvictionPolicy { return newLFUPolicy() },
+	"clock":  func() EvictionPolicy { return newClockPolicy() },
+}
+
+/**
+ * Names of the supported eviction policies, as a comma separated list.
+ */
+func EvictionPolicyNames() string {
+	names := make([]string, 0, len(evictionPolicies))
+	for name := range evictionPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+/**
+ * Returns an error if name is not a supported eviction policy.
+ */
+func CheckEvictionPolicy(name string) error {
+	_, err := newEvictionPolicy(name)
+	return err
+}
+
+func newEvictionPolicy(name string) (EvictionPolicy, error) {
+	constructor, ok := evictionPolicies[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown eviction policy '%s' (expected one of: %s)",
+			name, EvictionPolicyNames())
+	}
+	return constructor(), nil
+}
+
+/**
+ * Random eviction. This relies on Go's randomized map iteration order, which is
+ * exactly how the cache used to evict before policies were pluggable.
+ */
+type randomPolicy struct {
+	keys map[string]bool
+}
+
+func newRandomPolicy() *randomPolicy {
+	return &randomPolicy{make(map[string]bool)}
+}
+
+func (p *randomPolicy) Insert(key string) { p.keys[key] = true }
+
+func (p *randomPolicy) Hit(key string) {}
+
+func (p *randomPolicy) Remove(key string) { delete(p.keys, key) }
+
+func (p *randomPolicy) Victim() (string, bool) {
+	for k := range p.keys {
+		return k, true
+	}
+	return "", false
+}
+
+/**
+ * Least recently used eviction. The front of the list is the most recently used key.
+ */
+type lruPolicy struct {
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{list.New(), make(map[string]*list.Element)}
+}
+
+func (p *lruPolicy) Insert(key string) {
+	if elem, ok := p.elements[key]; ok {
+		p.order.MoveToFront(elem)
+		return
+	}
+	p.elements[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) Hit(key string) {
+	if elem, ok := p.elements[key]; ok {
+		p.order.MoveToFront(elem)
+	}
+}
+
+func (p *lruPolicy) Remove(key string) {
+	if elem, ok := p.elements[key]; ok {
+		p.order.Remove(elem)
+		delete(p.elements, key)
+	}
+}
+
+func (p *lruPolicy) Victim() (string, bool) {
+	back := p.order.Back()
+	if back == nil {
+		return "", false
+	}
+	return back.Value.(string), true
+}
+
+/**
+ * Least frequently used eviction. Ties on the hit count are broken by evicting the
+ * key that was touched the longest time ago.
+ */
+type lfuItem struct {
+	key   string
+	freq  int
+	tick  uint64
+	index int
+}
+
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq == h[j].freq {
+		return h[i].tick < h[j].tick
+	}
+	return h[i].freq < h[j].freq
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+type lfuPolicy struct {
+	items map[string]*lfuItem
+	heap  lfuHeap
+	tick  uint64
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{items: make(map[string]*lfuItem)}
+}
+
+func (p *lfuPolicy) Insert(key string) {
+	p.tick++
+	if item, ok := p.items[key]; ok {
+		item.freq, item.tick = 1, p.tick
+		heap.Fix(&p.heap, item.index)
+		return
+	}
+	item := &lfuItem{key: key, freq: 1, tick: p.tick}
+	p.items[key] = item
+	heap.Push(&p.heap, item)
+}
+
+func (p *lfuPolicy) Hit(key string) {
+	if item, ok := p.items[key]; ok {
+		p.tick++
+		item.freq++
+		item.tick = p.tick
+		heap.Fix(&p.heap, item.index)
+	}
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	if item, ok := p.items[key]; ok {
+		heap.Remove(&p.heap, item.index)
+		delete(p.items, key)
+	}
+}
+
+func (p *lfuPolicy) Victim() (string, bool) {
+	if len(p.heap) == 0 {
+		return "", false
+	}
+	return p.heap[0].key, true
+}
+
+/**
+ * CLOCK (second chance) eviction. Keys sit on a circular list with a reference bit
+ * that is set on every hit. The hand sweeps the list, clearing bits, and evicts the
+ * first key it finds without one.
+ */
+type clockEntry struct {
+	key        string
+	referenced bool
+}
+
+type clockPolicy struct {
+	ring     *list.List
+	elements map[string]*list.Element
+	hand     *list.Element
+}
+
+func newClockPolicy() *clockPolicy {
+	return &clockPolicy{list.New(), make(map[string]*list.Element), nil}
+}
+
+func (p *clockPolicy) advance() {
+	if p.hand = p.hand.Next(); p.hand == nil {
+		p.hand = p.ring.Front()
+	}
+}
+
+func (p *clockPolicy) Insert(key string) {
+	if elem, ok := p.elements[key]; ok {
+		elem.Value.(*clockEntry).referenced = true
+		return
+	}
+	entry := &clockEntry{key, false}
+	if p.hand == nil {
+		p.hand = p.ring.PushBack(entry)
+		p.elements[key] = p.hand
+	} else {
+		p.elements[key] = p.ring.InsertBefore(entry, p.hand) // Furthest from the hand.
+	}
+}
+
+func (p *clockPolicy) Hit(key string) {
+	if elem, ok := p.elements[key]; ok {
+		elem.Value.(*clockEntry).referenced = true
+	}
+}
+
+func (p *clockPolicy) Remove(key string) {
+	elem, ok := p.elements[key]
+	if !ok {
+		return
+	}
+	if elem == p.hand {
+		p.advance()
+		if p.hand == elem {
+			p.hand = nil // Last key on the clock.
+		}
+	}
+	p.ring.Remove(elem)
+	delete(p.elements, key)
+}
+
+func (p *clockPolicy) Victim() (string, bool) {
+	if p.hand == nil {
+		return "", false
+	}
+	for {
+		entry := p.hand.Value.(*clockEntry)
+		if !entry.referenced {
+			return entry.key, true
+		}
+		entry.referenced = false
+		p.advance()
+	}
+}
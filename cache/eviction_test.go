@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+)
+
+/*
+ *	Removes the victim from the policy (like the map operator would) and returns it.
+ */
+func evictNext(policy EvictionPolicy, t *testing.T) string {
+	victim, ok := policy.Victim()
+	if !ok {
+		t.Errorf("The policy did not return a victim when it still had keys!")
+		return ""
+	}
+	policy.Remove(victim)
+	return victim
+}
+
+func validateVictims(policy EvictionPolicy, expected []string, t *testing.T) (failed bool) {
+	for _, key := range expected {
+		if victim := evictNext(policy, t); victim != key {
+			failed = true
+			t.Errorf("Evicted the wrong key! Expected: (%s), Actual: (%s)", key, victim)
+		}
+	}
+	if victim, ok := policy.Victim(); ok {
+		failed = true
+		t.Errorf("The policy returned a victim (%s) when it should be empty!", victim)
+	}
+	return failed
+}
+
+// ============ Eviction Policy Tests ============
+
+func TestEvictionPolicyUnknown(t *testing.T) {
+	if _, err := newEvictionPolicy("fifo"); err == nil {
+		t.Errorf("An unknown eviction policy should have returned an error!")
+	}
+	for _, name := range []string{"random", "lru", "lfu", "clock", "LRU"} {
+		if _, err := newEvictionPolicy(name); err != nil {
+			t.Errorf("Could not build the '%s' eviction policy: %v", name, err)
+		}
+	}
+}
+
+func TestEvictionPolicyRandomEmptiesOut(t *testing.T) {
+	policy := newRandomPolicy()
+	seen := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		policy.Insert(fmt.Sprintf("/%v", i))
+	}
+	for i := 0; i < 10; i++ {
+		victim := evictNext(policy, t)
+		if seen[victim] {
+			t.Errorf("The key (%s) was evicted twice!", victim)
+		}
+		seen[victim] = true
+	}
+	if _, ok := policy.Victim(); ok {
+		t.Errorf("The policy returned a victim when it should be empty!")
+	}
+}
+
+func TestEvictionPolicyLRU(t *testing.T) {
+	policy := newLRUPolicy()
+	policy.Insert("a")
+	policy.Insert("b")
+	policy.Insert("c")
+	policy.Hit("a") // Order (oldest first) is now: b, c, a
+	policy.Insert("d")
+	policy.Hit("c") // Order (oldest first) is now: b, a, d, c
+	validateVictims(policy, []string{"b", "a", "d", "c"}, t)
+}
+
+func TestEvictionPolicyLFU(t *testing.T) {
+	policy := newLFUPolicy()
+	policy.Insert("a")
+	policy.Insert("b")
+	policy.Insert("c")
+	policy.Hit("a")
+	policy.Hit("a")
+	policy.Hit("c")
+	policy.Insert("d")
+	// b and d were never hit, b is older. Then c (1 hit) and finally a (2 hits).
+	validateVictims(policy, []string{"b", "d", "c", "a"}, t)
+}
+
+func TestEvictionPolicyClock(t *testing.T) {
+	policy := newClockPolicy()
+	policy.Insert("a")
+	policy.Insert("b")
+	policy.Insert("c")
+	policy.Hit("a")
+	// The hand starts on a, which gets a second chance, so b goes first.
+	if victim := evictNext(policy, t); victim != "b" {
+		t.Errorf("Evicted the wrong key! Expected: (b), Actual: (%s)", victim)
+	}
+	policy.Hit("c")
+	policy.Insert("d")
+	// The hand is on c (second chance) and then reaches a, whose bit was cleared by the first sweep.
+	validateVictims(policy, []string{"a", "d", "c"}, t)
+}
+
+// ============ End of Eviction Policy Tests ============
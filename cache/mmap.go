@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"errors"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+var errMmapUnsupported = errors.New("memory mapping is not supported on this platform")
+
+/**
+ * A read-only memory mapping of a file (see Options.MmapSize). The cache entry holds one
+ * reference, and so does every File (and miss response) handed out with its data. It is
+ * unmapped once the last reference is released, so an evicted file stays mapped until the
+ * responses that still send it are done. A reference can only be taken by someone who
+ * already holds one (e.g. the map operator, for the entry). The entry's stamp is the one
+ * of the mapped file, so a revalidation (see Options.TTL) drops a mapping whose file changed.
+ */
+type mapping struct {
+	data   []byte
+	refs   int32
+	mapped *int64 // Counter of the bytes mapped by the cache (see Stats.MappedBytes).
+}
+
+/**
+ * Maps a file (of at least one byte, by its full path) with one reference held by the
+ * caller. Fails with ErrFileChanged if the file no longer has the expected stamp (when
+ * it is known), e.g. it was rewritten since it was stat'ed.
+ */
+func (c *Cache) mapFile(path string, expected fileStamp) (*mapping, error) {
+	data, info, err := mmapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	stamp := fileStamp{info.ModTime(), info.Size()}
+	if expected.known() && !stamp.equal(expected) {
+		_ = munmapFile(data)
+		return nil, ErrFileChanged
+	}
+	atomic.AddInt64(&c.mappedBytes, int64(len(data)))
+	return &mapping{data, 1, &c.mappedBytes}, nil
+}
+
+/**
+ * Runs fn, turning the memory fault (SIGBUS) of reading a mapping whose file shrank into
+ * ErrFileChanged instead of a crash. Only the faults of the calling goroutine are caught.
+ */
+func guardFaults(fn func() error) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			if _, fault := r.(interface{ Addr() uintptr }); !fault {
+				panic(r)
+			}
+			err = ErrFileChanged
+		}
+	}()
+	return fn()
+}
+
+/**
+ * Both are no-ops on a nil mapping (data on the heap).
+ */
+func (m *mapping) acquire() {
+	if m != nil {
+		atomic.AddInt32(&m.refs, 1)
+	}
+}
+
+func (m *mapping) release() {
+	if m != nil && atomic.AddInt32(&m.refs, -1) == 0 {
+		_ = munmapFile(m.data)
+		atomic.AddInt64(m.mapped, -int64(len(m.data)))
+	}
+}
+
+/**
+ * Lets go of the file's data. A memory-mapped file (see Options.MmapSize) is unmapped
+ * once every File with its data is released and it left the cache, so Data must not be
+ * used after this. Files that are not mapped don't need it, but it never hurts. Call it
+ * once per File.
+ */
+func (f *File) Release() {
+	if f != nil && f.mapping != nil {
+		f.mapping.release()
+		f.mapping = nil
+	}
+}
+
+/**
+ * Whether the file's data is memory-mapped (see Options.MmapSize).
+ */
+func (f *File) Mapped() bool {
+	return f.mapping != nil
+}
+
+/**
+ * Hands the file's data to fn and returns its error. A mapped file (see Options.MmapSize)
+ * can be truncated on disk while it is read: reading past its new end then returns
+ * ErrFileChanged (fn stops where it was) instead of crashing. The file should be dropped
+ * from the cache then (see Invalidate). Only the reads made by fn itself are covered, not
+ * the ones of other goroutines it hands the data to. Use it for the reads of Data that may
+ * take a while, e.g. sending it.
+ */
+func (f *File) ReadData(fn func(data []byte) error) error {
+	if f.mapping == nil {
+		return fn(f.Data)
+	}
+	return guardFaults(func() error {
+		return fn(f.Data)
+	})
+}
+
+/**
+ * Releases every file, e.g. the ones removed by an eviction (see Evict and Resize).
+ */
+func ReleaseFiles(files []*File) {
+	for _, file := range files {
+		file.Release()
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package cache
+
+import "os"
+
+/**
+ * Memory mapping is not supported here, the files are read into the heap instead.
+ */
+func mmapFile(filename string) ([]byte, os.FileInfo, error) {
+	return nil, nil, errMmapUnsupported
+}
+
+func munmapFile(data []byte) error {
+	return errMmapUnsupported
+}
@@ -0,0 +1,34 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package cache
+
+import (
+	"os"
+	"syscall"
+)
+
+/**
+ * Maps a whole file read-only, along with the info of the file it mapped. Empty files
+ * can't be mapped.
+ */
+func mmapFile(filename string) ([]byte, os.FileInfo, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close() // The mapping outlives the fd.
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size() == 0 || !info.Mode().IsRegular() {
+		return nil, nil, errMmapUnsupported
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	return data, info, err
+}
+
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,171 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+ *	Builds a cache over dir that maps the files of at least mmapSize bytes.
+ */
+func newMappingCache(dir string, capacity int, mmapSize int64, t *testing.T) *Cache {
+	c, err := New(Options{Capacity: capacity, Timeout: time.Second, Dir: dir, MmapSize: mmapSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func validateMappedBytes(c *Cache, expected int64, t *testing.T) {
+	if stats := c.Stats(); stats.MappedBytes != expected {
+		t.Errorf("Wrong number of mapped bytes! Expected: (%v), Actual: (%v)", expected, stats.MappedBytes)
+	}
+}
+
+func TestCacheMmap(t *testing.T) {
+	dir := t.TempDir()
+	big := bytes.Repeat([]byte("mapped "), 20)
+	rewriteFile(dir+"/big", string(big), t)
+	rewriteFile(dir+"/small", "heap", t)
+	c := newMappingCache(dir, 1000, 50, t)
+	defer c.Close()
+
+	first, err := c.Get(context.Background(), "/big")
+	if err != nil || !bytes.Equal(first.Data, big) || first.mapping == nil {
+		t.Fatalf("The big file should have been mapped! Actual: (%+v, %v)", first, err)
+	}
+	small, err := c.Get(context.Background(), "/small")
+	if err != nil || string(small.Data) != "heap" || small.mapping != nil {
+		t.Errorf("The small file should have been read into the heap! Actual: (%+v, %v)", small, err)
+	}
+	small.Release()
+	second, err := c.Get(context.Background(), "/big")
+	if err != nil || !second.Hit || !bytes.Equal(second.Data, big) {
+		t.Errorf("The mapped file should be a hit! Actual: (%+v, %v)", second, err)
+	}
+	if stats := c.Stats(); stats.BytesUsed != len(big)+len("heap") {
+		t.Errorf("The mapped bytes should count against the capacity! Actual: (%v bytes used)", stats.BytesUsed)
+	}
+	validateMappedBytes(c, int64(len(big)), t)
+
+	// Evicted, but still mapped until every file that uses it is released.
+	removed := c.Evict("/big")
+	if len(removed) != 1 || !bytes.Equal(removed[0].Data, big) {
+		t.Errorf("Wrong removed files: (%v)", removed)
+	}
+	first.Release()
+	second.Release()
+	validateMappedBytes(c, int64(len(big)), t)
+	if !bytes.Equal(removed[0].Data, big) {
+		t.Errorf("An evicted file lost its data before it was released!")
+	}
+	ReleaseFiles(removed)
+	validateMappedBytes(c, 0, t)
+
+	// Replaced on disk: the next miss maps the new file.
+	bigger := bytes.Repeat([]byte("remapped "), 20)
+	if err := ioutil.WriteFile(dir+"/big.new", bigger, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(dir+"/big.new", dir+"/big"); err != nil {
+		t.Fatal(err)
+	}
+	file, err := c.Get(context.Background(), "/big")
+	if err != nil || !bytes.Equal(file.Data, bigger) {
+		t.Errorf("The replaced file was not mapped again! Actual: (%+v, %v)", file, err)
+	}
+	file.Release()
+	validateMappedBytes(c, int64(len(bigger)), t)
+	c.Clear()
+	validateMappedBytes(c, 0, t)
+}
+
+func TestCacheMmapRewrittenInPlace(t *testing.T) {
+	dir := t.TempDir()
+	big := bytes.Repeat([]byte("mapped "), 64*1024) // Many pages, even on 16K page systems.
+	rewriteFile(dir+"/big", string(big), t)
+	c := newMappingCache(dir, len(big), 50, t)
+	defer c.Close()
+
+	first, err := c.Get(context.Background(), "/big")
+	if err != nil || first.mapping == nil {
+		t.Fatalf("The big file should have been mapped! Actual: (%+v, %v)", first, err)
+	}
+	// Truncated in place: its pages past the new end are gone, reading them must not crash.
+	rewriteFile(dir+"/big", "rewritten", t)
+	if err := first.ReadData(func(data []byte) error {
+		if data[len(data)-1] == big[len(big)-1] {
+			t.Errorf("The truncated pages should not have been readable!")
+		}
+		return nil
+	}); err != ErrFileChanged {
+		t.Errorf("Reading the truncated file should have failed! Actual: (%v)", err)
+	}
+	// Hits don't stat the file, it is served until it is dropped.
+	second, err := c.Get(context.Background(), "/big")
+	if err != nil || !second.Hit || !second.Mapped() {
+		t.Errorf("The mapped file should still be a hit! Actual: (%+v, %v)", second, err)
+	}
+	second.Release()
+	c.Invalidate("/big")
+	third, err := c.Get(context.Background(), "/big")
+	if err != nil || third.Hit || string(third.Data) != "rewritten" {
+		t.Errorf("The rewritten file should have been read again! Actual: (%+v, %v)", third, err)
+	}
+	first.Release()
+	third.Release()
+	validateMappedBytes(c, 0, t)
+}
+
+func TestCacheMmapConcurrentEvictions(t *testing.T) {
+	dir := t.TempDir()
+	names := make([]string, 8)
+	for i := range names {
+		names[i] = fmt.Sprintf("/file%v", i)
+		rewriteFile(dir+names[i], string(bytes.Repeat([]byte{byte('a' + i)}, 4096)), t)
+	}
+	// Room for 3 files, so the hits race with the evictions.
+	c := newMappingCache(dir, 3*4096, 1, t)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				name := names[(i+j)%len(names)]
+				file, err := c.Get(context.Background(), name)
+				if err != nil {
+					t.Errorf("Could not get (%s): %v", name, err)
+					return
+				}
+				// Touching unmapped data would crash the test.
+				if file.Data[0] != file.Data[len(file.Data)-1] {
+					t.Errorf("Got corrupted data for (%s)!", name)
+				}
+				file.Release()
+				if j%50 == 0 {
+					c.Clear()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	c.Clear()
+	validateMappedBytes(c, 0, t)
+	file, _ := c.Get(context.Background(), names[0])
+	c.Close()
+	if mapped := c.Stats().MappedBytes; mapped != 4096 {
+		t.Errorf("A file that is still out should stay mapped after the close! Actual: (%v)", mapped)
+	}
+	file.Release()
+	validateMappedBytes(c, 0, t)
+}
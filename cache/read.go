@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+/**
+ * Reads a file (name under dir) on a cache miss. The context is canceled once nobody is
+ * waiting on the read anymore, so the read can stop early.
+ */
+type ReadFunc func(ctx context.Context, dir, name string) ([]byte, error)
+
+/**
+ * Turns a userlib style read function into a ReadFunc that runs to completion.
+ */
+func IgnoreContext(read func(dir, name string) ([]byte, error)) ReadFunc {
+	return func(ctx context.Context, dir, name string) ([]byte, error) {
+		return read(dir, name)
+	}
+}
+
+const readChunkSize = 64 * 1024
+
+/**
+ * Reads a file off the disk in chunks, checking the context between chunks. The dir is
+ * joined with the name like userlib.ReadFile does, so it may lack a trailing slash.
+ */
+func ReadFile(ctx context.Context, dir, name string) ([]byte, error) {
+	file, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var data []byte
+	if info, err := file.Stat(); err == nil {
+		data = make([]byte, 0, info.Size())
+	}
+	chunk := make([]byte, readChunkSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n, err := file.Read(chunk)
+		data = append(data, chunk[:n]...)
+		if err == io.EOF {
+			return data, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+/**
+ * Cache statistics. The counters are totals since the cache was built (they survive
+ * clears). Hits, misses, timeouts, file errors, stale hits, too large files and in-flight
+ * misses come from operateCache, the disk tier (see Options.DiskDir) fills in its own
+ * part and the rest comes from mapOperator.
+ */
+type Stats struct {
+	Items          int       `json:"items"`
+	BytesUsed      int       `json:"bytes_used"`
+	Capacity       int       `json:"capacity"`
+	Hits           uint64    `json:"hits"`
+	Misses         uint64    `json:"misses"`
+	Evictions      uint64    `json:"evictions"`
+	Timeouts       uint64    `json:"timeouts"`
+	FileErrors     uint64    `json:"file_errors"`
+	StaleHits      uint64    `json:"stale_hits"`   // Expired files served while revalidating, or after a failed read.
+	TooLarge       uint64    `json:"too_large"`    // Misses on files too large to cache (see Options.MaxFileSize).
+	MappedBytes    int64     `json:"mapped_bytes"` // Memory-mapped (see Options.MmapSize), including evicted files still being sent.
+	InFlightMisses int       `json:"in_flight_misses"`
+	DiskItems      int       `json:"disk_items"`
+	DiskBytesUsed  int64     `json:"disk_bytes_used"`
+	DiskCapacity   int64     `json:"disk_capacity"`
+	DiskHits       uint64    `json:"disk_hits"` // Misses served from the disk tier.
+	TopKeys        []KeyHits `json:"top_keys"`
+	topN           int       // Number of keys to put in TopKeys.
+}
+
+type KeyHits struct {
+	Key     string `json:"key"`
+	Variant string `json:"variant,omitempty"`
+	Hits    int    `json:"hits"`
+}
+
+type statsRequest struct {
+	topN     int
+	response chan *Stats
+}
+
+const DefaultTopKeys = 10
+
+/**
+ * Returns the cache statistics, with the DefaultTopKeys most hit keys.
+ */
+func (c *Cache) Stats() *Stats {
+	return c.StatsTop(DefaultTopKeys)
+}
+
+/**
+ * Returns the cache statistics, with the (at most) topN most hit keys.
+ */
+func (c *Cache) StatsTop(topN int) *Stats {
+	request := statsRequest{topN, make(chan *Stats)}
+	var stats *Stats
+	select {
+	case c.cacheStatsChan <- &request:
+		stats = <-request.response
+	case <-c.closed:
+		// The cache threads are gone, so the counters can't change anymore.
+		stats = &Stats{Capacity: c.Capacity(), Hits: c.hits, Misses: c.misses,
+			Evictions: c.evictions, Timeouts: c.timeouts, FileErrors: c.fileErrors,
+			StaleHits: c.staleHits, TooLarge: c.tooLarge, MappedBytes: atomic.LoadInt64(&c.mappedBytes),
+			TopKeys: []KeyHits{}}
+	}
+	if c.disk != nil {
+		c.disk.fillStats(stats)
+	}
+	return stats
+}
+
+/**
+ * Returns the (at most) n cached keys with the most hits, ties are sorted by key.
+ */
+func topKeysByHits(table map[string]*cacheEntry, n int) []KeyHits {
+	if n <= 0 {
+		return []KeyHits{}
+	}
+	keys := make([]KeyHits, 0, len(table))
+	for k, entry := range table {
+		name, variant := splitKey(k)
+		keys = append(keys, KeyHits{name, variant, entry.count})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Hits == keys[j].Hits {
+			return variantKey(keys[i].Key, keys[i].Variant) < variantKey(keys[j].Key, keys[j].Variant)
+		}
+		return keys[i].Hits > keys[j].Hits
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
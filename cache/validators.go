@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/**
+ * Validators for a file's content, used to answer conditional requests. These are
+ * computed once when a file is read from disk and then live in the cache entry,
+ * so conditional requests that hit the cache never touch the disk.
+ */
+type Validators struct {
+	ETag    string    // Strong ETag, a (quoted) hash of the data.
+	ModTime time.Time // Zero when the modification time is unknown.
+}
+
+func NewValidators(data []byte, modTime time.Time) Validators {
+	sum := sha256.Sum256(data)
+	return Validators{"\"" + hex.EncodeToString(sum[:16]) + "\"", modTime}
+}
+
+/**
+ * A file's modification time and size on disk, to tell whether it changed since it was
+ * read (see Options.TTL). The size is -1 (and the time zero) if the file can't be found.
+ */
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(dir, filename string) fileStamp {
+	info, err := os.Stat(filepath.Join(dir, filename)) // Joined like userlib.ReadFile, the dir may lack a trailing slash.
+	if err != nil {
+		return fileStamp{time.Time{}, -1}
+	}
+	return fileStamp{info.ModTime(), info.Size()}
+}
+
+func (s fileStamp) known() bool {
+	return s.size >= 0
+}
+
+func (s fileStamp) equal(other fileStamp) bool {
+	return s.size == other.size && s.modTime.Equal(other.modTime)
+}
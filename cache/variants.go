@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"context"
+	"strings"
+)
+
+/**
+ * Reads a variant of a file (e.g. its "gzip" encoding) on a cache miss. No data (and no
+ * error) means the file has no such variant.
+ */
+type VariantFunc func(ctx context.Context, dir, name, variant string) ([]byte, error)
+
+/**
+ * Variants are cached under "<name>\x00<variant>". Filenames never hold a NUL byte, so
+ * these keys can't clash with a file.
+ */
+const variantSep = "\x00"
+
+func variantKey(name, variant string) string {
+	if variant == "" {
+		return name
+	}
+	return name + variantSep + variant
+}
+
+func splitKey(key string) (name, variant string) {
+	if i := strings.Index(key, variantSep); i >= 0 {
+		return key[:i], key[i+len(variantSep):]
+	}
+	return key, ""
+}
+
+/**
+ * The file of an entry. It shares the entry's mapping (if any), so the caller must hand
+ * it a reference of its own.
+ */
+func (entry *cacheEntry) file(hit bool) *File {
+	name, variant := splitKey(entry.filename)
+	return &File{name, variant, entry.data, entry.validators, hit, false, entry.mapping}
+}
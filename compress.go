@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server/cache"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Supported content encodings, from most to least preferred, with the extension of their
+ * precompressed sibling files (e.g. 'style.css.br') and the writer that compresses a file
+ * on the fly when there is no sibling.
+ */
+var encodings = []struct {
+	name      string
+	extension string
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+}{
+	{"br", ".br", func(w io.Writer) (io.WriteCloser, error) { return brotli.NewWriter(w), nil }},
+	{"zstd", ".zst", func(w io.Writer) (io.WriteCloser, error) {
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}},
+	{"gzip", ".gz", func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil }},
+}
+
+/**
+ * The file that a precompressed sibling (e.g. 'style.css.gz') is a variant of, ok is
+ * false if the filename has no encoding's extension.
+ */
+func precompressedBase(filename string) (base string, ok bool) {
+	for _, e := range encodings {
+		if strings.HasSuffix(filename, e.extension) {
+			return strings.TrimSuffix(filename, e.extension), true
+		}
+	}
+	return "", false
+}
+
+/**
+ * Files smaller than this aren't compressed on the fly, it isn't worth it.
+ */
+const minCompressSize = 256
+
+/**
+ * Content types that are compressed on the fly.
+ */
+func isCompressible(filename string) bool {
+	contentType := userlib.GetContentType(filename)
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.TrimSpace(strings.ToLower(contentType))
+	if strings.HasPrefix(contentType, "text/") {
+		return true
+	}
+	switch contentType {
+	case "application/javascript", "application/x-javascript", "application/json",
+		"application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+/**
+ * Parses an Accept-Encoding header and returns the supported encodings that it accepts
+ * (with a non-zero q-value), in order of preference.
+ */
+func acceptedEncodings(r *http.Request) []string {
+	header := r.Header.Get("Accept-Encoding")
+	if header == "" {
+		return nil
+	}
+	qValues := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		qValues[coding] = q
+	}
+	var accepted []string
+	for _, encoding := range encodings {
+		q, ok := qValues[encoding.name]
+		if !ok {
+			q, ok = qValues["*"]
+		}
+		if ok && q > 0 {
+			accepted = append(accepted, encoding.name)
+		}
+	}
+	return accepted
+}
+
+/**
+ * Gets the most preferred encoded variant of a file that the request accepts, nil if
+ * there is none (the file should then be sent as is).
+ */
+func fetchEncodedFile(ctx context.Context, r *http.Request, filename string) (*cache.File, error) {
+	for _, encoding := range acceptedEncodings(r) {
+		file, err := fileCache.GetVariant(ctx, filename, encoding)
+		if err != nil {
+			return nil, err
+		}
+		if len(file.Data) > 0 {
+			return file, nil
+		}
+		file.Release()
+	}
+	return nil, nil
+}
+
+/**
+ * Reads an encoded variant of a file on a cache miss (see cache.VariantFunc). A sibling
+ * file with the encoding's extension wins, it is read like the file itself (see
+ * missReadFunc). Otherwise the (cached) file is compressed on the fly. No data means
+ * there is no such variant.
+ */
+func readEncodedFile(ctx context.Context, dir, filename, encoding string) ([]byte, error) {
+	for _, e := range encodings {
+		if e.name != encoding {
+			continue
+		}
+		if checkInsideRoot(filename+e.extension) == nil {
+			data, err := missReadFunc()(ctx, dir, filename+e.extension)
+			if err == nil && len(data) > 0 {
+				return data, nil
+			} else if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+		}
+		if !isCompressible(filename) {
+			return nil, nil
+		}
+		return compressFile(ctx, filename, e.newWriter)
+	}
+	return nil, nil
+}
+
+func compressFile(ctx context.Context, filename string, newWriter func(w io.Writer) (io.WriteCloser, error)) ([]byte, error) {
+	file, err := fileCache.Get(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Release()
+	if len(file.Data) < minCompressSize {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	writer, err := newWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.ReadData(func(data []byte) error {
+		_, err := writer.Write(data)
+		return err
+	}); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(file.Data) {
+		return nil, nil // Compressing didn't help.
+	}
+	return buf.Bytes(), nil
+}
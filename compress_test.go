@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func validateEncoding(resp *ResponseWriterTester, expected string, t *testing.T) (failed bool) {
+	if resp.header.Get("Content-Encoding") != expected {
+		failed = true
+		t.Errorf("Wrong Content-Encoding! Expected: (%s), Actual: (%s)", expected, resp.header.Get("Content-Encoding"))
+	}
+	if resp.header.Get("Vary") != "Accept-Encoding" {
+		failed = true
+		t.Errorf("Wrong Vary header! Expected: (Accept-Encoding), Actual: (%s)", resp.header.Get("Vary"))
+	}
+	return failed
+}
+
+/*
+ *	Decodes a response body of each encoding, see decode.
+ */
+var decoders = map[string]func(data []byte) ([]byte, error){
+	"gzip": func(data []byte) ([]byte, error) {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(gz)
+	},
+	"br": func(data []byte) ([]byte, error) {
+		return ioutil.ReadAll(brotli.NewReader(bytes.NewReader(data)))
+	},
+	"zstd": func(data []byte) ([]byte, error) {
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		return decoder.DecodeAll(data, nil)
+	},
+}
+
+func decode(data []byte, encoding string, t *testing.T) []byte {
+	plain, err := decoders[encoding](data)
+	if err != nil {
+		t.Fatalf("The response is not encoded with %s: %v", encoding, err)
+	}
+	return plain
+}
+
+// ============ Compression Tests ============
+
+func TestCompressAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected []string
+	}{
+		{"", nil},
+		{"gzip", []string{"gzip"}},
+		{"gzip, deflate, br", []string{"br", "gzip"}},
+		{"gzip;q=1.0, br;q=0", []string{"gzip"}},
+		{"zstd, GZIP;q=0.5", []string{"zstd", "gzip"}},
+		{"*", []string{"br", "zstd", "gzip"}},
+		{"*;q=0, gzip", []string{"gzip"}},
+		{"identity", nil},
+	}
+	for _, test := range tests {
+		req := genConditionalRequest("/file", "Accept-Encoding", test.header)
+		if accepted := acceptedEncodings(req); !reflect.DeepEqual(accepted, test.expected) {
+			t.Errorf("Wrong encodings for (%s)! Expected: (%v), Actual: (%v)", test.header, test.expected, accepted)
+		}
+	}
+}
+
+func TestCompressOnTheFly(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 10000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	name := "/style.css"
+	dataToBeRead := bytes.Repeat([]byte("body { color: #61c; } "), 50)
+	var reads uint64 = 0
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		atomic.AddUint64(&reads, 1)
+		if filename != "."+name {
+			return nil, os.ErrNotExist
+		}
+		data = dataToBeRead
+		return
+	})
+	for _, encoding := range []string{"br", "zstd", "gzip"} {
+		for i := 0; i < 3; i++ {
+			resp := genResponseTestWriter()
+			handler(resp, genConditionalRequest(name, "Accept-Encoding", encoding))
+			validateFileResponse("."+name, "."+name, nil, resp, userlib.SUCCESSCODE, t)
+			validateEncoding(resp, encoding, t)
+			if !bytes.Equal(decode(resp.data, encoding, t), dataToBeRead) {
+				t.Errorf("The %s response did not hold the file!", encoding)
+			}
+		}
+	}
+	// The file itself and its three variants are cached.
+	stats := fileCache.Stats()
+	if stats.Items != 4 || stats.BytesUsed <= len(dataToBeRead) || stats.BytesUsed >= 2*len(dataToBeRead) {
+		t.Errorf("Wrong cache usage! Expected: (4 items, the file and its variants), Actual: (%v items, %v bytes)", stats.Items, stats.BytesUsed)
+	}
+	// One read of the file, one (failed) read of each sibling.
+	validateNumberOfReads(4, reads, t)
+	// The most preferred encoding wins, without Accept-Encoding the file is sent as is.
+	resp := genResponseTestWriter()
+	handler(resp, genConditionalRequest(name, "Accept-Encoding", "gzip, br"))
+	validateEncoding(resp, "br", t)
+	resp = requestFile(name, secTimeout, t)
+	validateFileResponse("."+name, "."+name, dataToBeRead, resp, userlib.SUCCESSCODE, t)
+	validateEncoding(resp, "", t)
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestCompressVariantErrors(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 10000
+	msTimeout := 200
+	capacity = secCap
+	timeoutMs = msTimeout
+	workingDir = ""
+	launchCache()
+	timeoutMs = 0 // Only the cache we just launched should use it.
+	var reads uint64 = 0
+	// We set the userlib FileRead function to this custom 'read': a failing and a slow disk.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		switch filename {
+		case "./broken.css":
+			atomic.AddUint64(&reads, 1)
+			return nil, errors.New("I/O error")
+		case "./slow.css":
+			time.Sleep(time.Duration(msTimeout*4) * time.Millisecond)
+			return bytes.Repeat([]byte("body { color: #61c; } "), 50), nil
+		}
+		return nil, os.ErrNotExist
+	})
+	// The error of the variant is the answer, the file isn't read a second time.
+	resp := genResponseTestWriter()
+	handler(resp, genConditionalRequest("/broken.css", "Accept-Encoding", "gzip"))
+	if resp.statusCode != userlib.FILEERRORCODE {
+		t.Errorf("Received the wrong status code! Expected: (%v), Actual: (%v)", userlib.FILEERRORCODE, resp.statusCode)
+	}
+	validateNumberOfReads(1, reads, t)
+	// Nor does a timeout wait again on the plain file.
+	start := time.Now()
+	resp = genResponseTestWriter()
+	handler(resp, genConditionalRequest("/slow.css", "Accept-Encoding", "gzip"))
+	validateTimeout(resp, t)
+	if took := time.Now().Sub(start); took > time.Duration(msTimeout*3/2)*time.Millisecond {
+		t.Errorf("The timeout should have been %vms! It took: %v", msTimeout, took)
+	}
+	launchCache()
+}
+
+func TestCompressSkipsSmallAndBinaryFiles(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 10000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	files := map[string][]byte{
+		"/small.html": []byte("<p>CS61C</p>"),
+		"/image.gif":  bytes.Repeat([]byte("GIF89a"), 100),
+	}
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		if data, ok := files[filename[1:]]; ok {
+			return data, nil
+		}
+		return nil, os.ErrNotExist
+	})
+	for name, data := range files {
+		resp := genResponseTestWriter()
+		handler(resp, genConditionalRequest(name, "Accept-Encoding", "gzip"))
+		validateFileResponse("."+name, "."+name, data, resp, userlib.SUCCESSCODE, t)
+		validateEncoding(resp, "", t)
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestCompressPrecompressedSiblings(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 10000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	dir, err := ioutil.TempDir("", "compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	workingDir = dir + "/"
+	launchCache()
+	name := "/index.html"
+	plain := []byte("<html>CS61C is the best class in the world!</html>")
+	siblings := map[string][]byte{"": plain, ".br": []byte("brotli bytes"), ".zst": []byte("zstd bytes")}
+	for ext, data := range siblings {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+ext), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// We set the userlib FileRead function to read from the temp dir.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		return ioutil.ReadFile(workingDir + filename)
+	})
+	tests := []struct {
+		header   string
+		encoding string
+		data     []byte
+	}{
+		{"gzip, deflate, br, zstd", "br", siblings[".br"]},
+		{"gzip, zstd", "zstd", siblings[".zst"]},
+		{"gzip", "", plain}, // No sibling and too small to compress.
+		{"", "", plain},
+	}
+	var etags []string
+	for _, test := range tests {
+		resp := genResponseTestWriter()
+		handler(resp, genConditionalRequest(name, "Accept-Encoding", test.header))
+		validateFileResponse("."+name, "."+name, test.data, resp, userlib.SUCCESSCODE, t)
+		validateEncoding(resp, test.encoding, t)
+		etags = append(etags, resp.header.Get("ETag"))
+	}
+	if etags[0] == etags[1] || etags[0] == etags[3] || etags[1] == etags[3] {
+		t.Errorf("Every encoding should have its own ETag! Actual: (%v)", etags)
+	}
+	// A conditional request is checked against the variant that would be sent.
+	req := genConditionalRequest(name, "Accept-Encoding", "br")
+	req.Header.Set("If-None-Match", etags[0])
+	resp := genResponseTestWriter()
+	handler(resp, req)
+	validateNotModified(resp, t)
+	// Invalidating the file drops its variants.
+	fileCache.Invalidate("." + name)
+	if stats := fileCache.Stats(); stats.Items != 0 {
+		t.Errorf("The variants outlived their file! Items left: (%v)", stats.Items)
+	}
+	workingDir = ""
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+// ============ End of Compression Tests ============
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server/cache"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/**
+ * Sets the ETag and Last-Modified headers for a response.
+ */
+func setValidatorHeaders(w http.ResponseWriter, validators cache.Validators) {
+	if validators.ETag != "" {
+		w.Header().Set("ETag", validators.ETag)
+	}
+	if !validators.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", validators.ModTime.UTC().Format(http.TimeFormat))
+	}
+}
+
+/**
+ * Checks the If-None-Match and If-Modified-Since request headers against a file's
+ * validators. If-Modified-Since is ignored when If-None-Match is present (RFC 7232).
+ */
+func isNotModified(r *http.Request, validators cache.Validators) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if validators.ETag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/") // Weak comparison.
+			if tag == "*" || tag == validators.ETag {
+				return true
+			}
+		}
+		return false
+	}
+	if since := r.Header.Get("If-Modified-Since"); since != "" && !validators.ModTime.IsZero() {
+		sinceTime, err := http.ParseTime(since)
+		if err != nil {
+			return false
+		}
+		// HTTP dates only have second precision.
+		return !validators.ModTime.Truncate(time.Second).After(sinceTime)
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server/cache"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+ *	Generates a request for the url with the given (conditional) header set.
+ */
+func genConditionalRequest(urlpath, header, value string) *http.Request {
+	req := genRequestUrl(urlpath)
+	req.Header = http.Header{}
+	req.Header.Set(header, value)
+	return req
+}
+
+func validateNotModified(resp *ResponseWriterTester, t *testing.T) (failed bool) {
+	if resp.statusCode != http.StatusNotModified {
+		failed = true
+		t.Errorf("Received the wrong status code! Expected: (%v), Actual: (%v)", http.StatusNotModified, resp.statusCode)
+	}
+	if len(resp.data) != 0 {
+		failed = true
+		t.Errorf("A 304 response should not have a body! Actual: (%s)", string(resp.data))
+	}
+	return failed
+}
+
+// ============ Conditional GET Tests ============
+
+func TestConditionalValidators(t *testing.T) {
+	modTime := time.Date(2019, time.May, 6, 12, 30, 15, 500, time.UTC)
+	validators := cache.NewValidators([]byte("CS61C is the best class in the world!"), modTime)
+	other := cache.NewValidators([]byte("CS61C is the worst class ever!"), modTime)
+	if validators.ETag == other.ETag {
+		t.Errorf("Two different files got the same ETag: (%s)", validators.ETag)
+	}
+	if validators.ETag != cache.NewValidators([]byte("CS61C is the best class in the world!"), time.Time{}).ETag {
+		t.Errorf("The same data got two different ETags!")
+	}
+	tests := []struct {
+		header   string
+		value    string
+		expected bool
+	}{
+		{"If-None-Match", validators.ETag, true},
+		{"If-None-Match", "W/" + validators.ETag, true},
+		{"If-None-Match", other.ETag + ", " + validators.ETag, true},
+		{"If-None-Match", "*", true},
+		{"If-None-Match", other.ETag, false},
+		{"If-Modified-Since", modTime.Format(http.TimeFormat), true},
+		{"If-Modified-Since", modTime.Add(time.Hour).Format(http.TimeFormat), true},
+		{"If-Modified-Since", modTime.Add(-time.Second).Format(http.TimeFormat), false},
+		{"If-Modified-Since", "not a date", false},
+		{"If-Range", validators.ETag, false},
+	}
+	for _, test := range tests {
+		req := genConditionalRequest("/file", test.header, test.value)
+		if actual := isNotModified(req, validators); actual != test.expected {
+			t.Errorf("Wrong result for %s: (%s)! Expected: (%v), Actual: (%v)", test.header, test.value, test.expected, actual)
+		}
+	}
+	// If-None-Match wins over If-Modified-Since.
+	req := genConditionalRequest("/file", "If-None-Match", other.ETag)
+	req.Header.Set("If-Modified-Since", modTime.Format(http.TimeFormat))
+	if isNotModified(req, validators) {
+		t.Errorf("If-Modified-Since should be ignored when If-None-Match is present!")
+	}
+}
+
+func TestConditionalETagFromCache(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	name := "/etag.html"
+	dataToBeRead := []byte("CS61C is the best class in the world! Emperor Nick shall reign supreme.")
+	var reads uint64 = 0
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		atomic.AddUint64(&reads, 1)
+		data = dataToBeRead
+		return
+	})
+	resp := requestFile(name, secTimeout, t)
+	validateFileResponse("."+name, "."+name, dataToBeRead, resp, userlib.SUCCESSCODE, t)
+	etag := resp.header.Get("ETag")
+	if etag == "" {
+		t.Fatalf("The response did not have an ETag!")
+	}
+	// Same ETag, this is served from the cache.
+	resp = genResponseTestWriter()
+	handler(resp, genConditionalRequest(name, "If-None-Match", etag))
+	validateNotModified(resp, t)
+	if resp.header.Get("ETag") != etag {
+		t.Errorf("The 304 response had the wrong ETag! Expected: (%s), Actual: (%s)", etag, resp.header.Get("ETag"))
+	}
+	// Different ETag, so the full file comes back.
+	resp = genResponseTestWriter()
+	handler(resp, genConditionalRequest(name, "If-None-Match", "\"61c\""))
+	validateFileResponse("."+name, "."+name, dataToBeRead, resp, userlib.SUCCESSCODE, t)
+	validateNumberOfReads(1, reads, t)
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestConditionalLastModified(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	dir, err := ioutil.TempDir("", "conditional")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := "/modified.txt"
+	dataToBeRead := []byte("CS61C is the best class in the world!")
+	modTime := time.Date(2019, time.May, 6, 12, 30, 15, 0, time.UTC)
+	if err := ioutil.WriteFile(filepath.Join(dir, name), dataToBeRead, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, name), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	var reads uint64 = 0
+	// We set the userlib FileRead function to read from the temp dir (joined like userlib does).
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		atomic.AddUint64(&reads, 1)
+		return ioutil.ReadFile(filepath.Join(workingDir, filename))
+	})
+	// The root works with or without a trailing slash (e.g. -d public_html).
+	for _, root := range []string{dir + "/", dir} {
+		workingDir = root
+		launchCache()
+		reads = 0
+		resp := requestFile(name, secTimeout, t)
+		validateFileResponse("."+name, "."+name, dataToBeRead, resp, userlib.SUCCESSCODE, t)
+		if resp.header.Get("Last-Modified") != modTime.Format(http.TimeFormat) {
+			t.Errorf("Wrong Last-Modified header with root (%s)! Expected: (%s), Actual: (%s)",
+				root, modTime.Format(http.TimeFormat), resp.header.Get("Last-Modified"))
+		}
+		resp = genResponseTestWriter()
+		handler(resp, genConditionalRequest(name, "If-Modified-Since", modTime.Format(http.TimeFormat)))
+		validateNotModified(resp, t)
+		resp = genResponseTestWriter()
+		handler(resp, genConditionalRequest(name, "If-Modified-Since", modTime.Add(-time.Hour).Format(http.TimeFormat)))
+		validateFileResponse("."+name, "."+name, dataToBeRead, resp, userlib.SUCCESSCODE, t)
+		validateNumberOfReads(1, reads, t)
+	}
+	workingDir = ""
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+// ============ End of Conditional GET Tests ============
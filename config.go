@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server/cache"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/**
+ * Every setting of the server. The flags fill one in, and a config file (-config) can
+ * set any of them (plus the ones without a flag, like the headers) by their key. Flags
+ * that are given on the command line win over the file. Settings tagged as live can
+ * change on a reload, the others need a restart.
+ */
+type config struct {
+	Port              int            `json:"port" toml:"port" yaml:"port" flag:"p"`
+	Capacity          int            `json:"capacity" toml:"capacity" yaml:"capacity" flag:"c" live:"true"`
+	Timeout           int            `json:"timeout" toml:"timeout" yaml:"timeout" flag:"t" live:"true"`
+	TimeoutMs         int            `json:"timeout_ms" toml:"timeout_ms" yaml:"timeout_ms" flag:"t-ms" live:"true"`
+	CancelReads       bool           `json:"cancel_reads" toml:"cancel_reads" yaml:"cancel_reads" flag:"cancel-reads"`
+	Dir               string         `json:"dir" toml:"dir" yaml:"dir" flag:"d"`
+	Eviction          string         `json:"eviction" toml:"eviction" yaml:"eviction" flag:"e"`
+	Watch             bool           `json:"watch" toml:"watch" yaml:"watch" flag:"w"`
+	AccessLog         string         `json:"access_log" toml:"access_log" yaml:"access_log" flag:"a"`
+	AccessLogFormat   string         `json:"access_log_format" toml:"access_log_format" yaml:"access_log_format" flag:"a-format"`
+	AccessLogMaxBytes int64          `json:"access_log_max_bytes" toml:"access_log_max_bytes" yaml:"access_log_max_bytes" flag:"a-size"`
+	AccessLogMaxAge   configDuration `json:"access_log_max_age" toml:"access_log_max_age" yaml:"access_log_max_age" flag:"a-age"`
+	AdminToken        string         `json:"admin_token" toml:"admin_token" yaml:"admin_token" flag:"admin-token"`
+	AdminPasswd       string         `json:"admin_passwd" toml:"admin_passwd" yaml:"admin_passwd" flag:"admin-passwd"`
+	AdminAllow        string         `json:"admin_allow" toml:"admin_allow" yaml:"admin_allow" flag:"admin-allow"`
+	AdminAddr         string         `json:"admin_addr" toml:"admin_addr" yaml:"admin_addr" flag:"admin-addr"`
+	TLSCert           string         `json:"tls_cert" toml:"tls_cert" yaml:"tls_cert" flag:"tls-cert"`
+	TLSKey            string         `json:"tls_key" toml:"tls_key" yaml:"tls_key" flag:"tls-key"`
+	TLSRedirect       int            `json:"tls_redirect" toml:"tls_redirect" yaml:"tls_redirect" flag:"tls-redirect"`
+	Drain             configDuration `json:"drain" toml:"drain" yaml:"drain" flag:"drain"`
+	TTL               configDuration `json:"ttl" toml:"ttl" yaml:"ttl" flag:"ttl" live:"true"`
+	TTLRules          []ttlRule      `json:"ttl_rules" toml:"ttl_rules" yaml:"ttl_rules" live:"true"`
+	StaleRevalidate   configDuration `json:"stale_while_revalidate" toml:"stale_while_revalidate" yaml:"stale_while_revalidate" flag:"stale-while-revalidate"`
+	StaleIfError      configDuration `json:"stale_if_error" toml:"stale_if_error" yaml:"stale_if_error" flag:"stale-if-error"`
+	Stream            int64          `json:"stream" toml:"stream" yaml:"stream" flag:"stream"`
+	Mmap              int64          `json:"mmap" toml:"mmap" yaml:"mmap" flag:"mmap"`
+	DiskCache         string         `json:"disk_cache" toml:"disk_cache" yaml:"disk_cache" flag:"disk-cache"`
+	DiskCacheCapacity int64          `json:"disk_cache_capacity" toml:"disk_cache_capacity" yaml:"disk_cache_capacity" flag:"disk-cache-capacity"`
+	Warm              string         `json:"warm" toml:"warm" yaml:"warm" flag:"warm"`
+	WarmConcurrency   int            `json:"warm_concurrency" toml:"warm_concurrency" yaml:"warm_concurrency" flag:"warm-concurrency"`
+	WarmWait          bool           `json:"warm_wait" toml:"warm_wait" yaml:"warm_wait" flag:"warm-wait"`
+	Logging           bool           `json:"logging" toml:"logging" yaml:"logging" flag:"l" live:"true"`
+	Headers           []headerRule   `json:"headers" toml:"headers" yaml:"headers" live:"true"`
+}
+
+/**
+ * Extra headers for the file responses whose path matches a glob (see path.Match),
+ * e.g. {"path": "/static/*.js", "set": {"Cache-Control": "max-age=3600"}}.
+ */
+type headerRule struct {
+	Path string            `json:"path" toml:"path" yaml:"path"`
+	Set  map[string]string `json:"set" toml:"set" yaml:"set"`
+}
+
+/**
+ * A duration written like the duration flags, e.g. "24h" or "1m30s".
+ */
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("bad duration '%s' (expected e.g. \"30s\" or \"24h\")", text)
+	}
+	*d = configDuration(parsed)
+	return nil
+}
+
+func (d configDuration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+/**
+ * Path of the config file (empty for none).
+ */
+var configPath string
+
+/**
+ * Registers the flags of every setting, they fill in c.
+ */
+func registerFlags(flags *flag.FlagSet, c *config) {
+	flags.StringVar(&configPath, "config", "", "Config file (.json, .toml or .yaml) with any of these settings, reloaded on SIGHUP.")
+	flags.IntVar(&c.Port, "p", 8080, "Port to listen for HTTP requests (default port 8080).")
+	flags.IntVar(&c.Capacity, "c", 1000000, "Number of bytes to allow in the cache.")
+	flags.IntVar(&c.Timeout, "t", 2, "Default timeout (in seconds) to wait before returning an error.")
+	flags.IntVar(&c.TimeoutMs, "t-ms", 0, "Timeout in milliseconds, overrides -t when set.")
+	flags.BoolVar(&c.CancelReads, "cancel-reads", false, "Read files on a miss with the server's own reader, which stops once no request waits on it.")
+	flags.StringVar(&c.Dir, "d", "public_html/", "The directory which the files are hosted in.")
+	flags.StringVar(&c.Eviction, "e", "random",
+		fmt.Sprintf("Cache eviction policy, one of: %v.", cache.EvictionPolicyNames()))
+	flags.BoolVar(&c.Watch, "w", false, "Watch the working dir and drop changed files from the cache (linux only).")
+	flags.StringVar(&c.AccessLog, "a", "", "File to write the access log to (off by default).")
+	flags.StringVar(&c.AccessLogFormat, "a-format", "combined", "Access log format, combined or json.")
+	flags.Int64Var(&c.AccessLogMaxBytes, "a-size", 0, "Rotate the access log once it grows past this many bytes (0 to never).")
+	flags.DurationVar((*time.Duration)(&c.AccessLogMaxAge), "a-age", 0, "Rotate the access log once it gets this old, e.g. 24h (0 to never).")
+	flags.StringVar(&c.AdminToken, "admin-token", "", "File holding the bearer token for the /cache/ and /metrics endpoints.")
+	flags.StringVar(&c.AdminPasswd, "admin-passwd", "", "File of 'user:bcrypt-hash' lines allowed into the admin endpoints.")
+	flags.StringVar(&c.AdminAllow, "admin-allow", "", "Comma separated IPs and CIDRs allowed into the admin endpoints.")
+	flags.StringVar(&c.AdminAddr, "admin-addr", "", "Serve the admin endpoints on this address only, e.g. 127.0.0.1:8081.")
+	flags.StringVar(&c.TLSCert, "tls-cert", "", "Certificate file (PEM) to serve HTTPS with, along with -tls-key.")
+	flags.StringVar(&c.TLSKey, "tls-key", "", "Private key file (PEM) of the -tls-cert certificate.")
+	flags.IntVar(&c.TLSRedirect, "tls-redirect", 0, "Port to redirect plain HTTP requests to HTTPS from (0 to turn it off).")
+	flags.DurationVar((*time.Duration)(&c.Drain), "drain", 30*time.Second, "How long to wait for open requests on SIGINT or SIGTERM before cutting them off.")
+	flags.DurationVar((*time.Duration)(&c.TTL), "ttl", 0, "How long files stay fresh in the cache, e.g. 10m (0 to never expire).")
+	flags.DurationVar((*time.Duration)(&c.StaleRevalidate), "stale-while-revalidate", 0, "How long expired files are still served while they are revalidated.")
+	flags.DurationVar((*time.Duration)(&c.StaleIfError), "stale-if-error", 0, "How long past their TTL expired files are served when reading them fails.")
+	flags.Int64Var(&c.Stream, "stream", 0, "Stream files bigger than this many bytes (or than the cache) off the disk instead of caching them (0 to never).")
+	flags.Int64Var(&c.Mmap, "mmap", 0, "Memory-map cached files of at least this many bytes instead of reading them into the heap (0 to never).")
+	flags.StringVar(&c.DiskCache, "disk-cache", "", "Directory of a second cache tier on the local disk, kept across restarts (off if empty).")
+	flags.Int64Var(&c.DiskCacheCapacity, "disk-cache-capacity", 1<<30, "Number of bytes to allow in the -disk-cache tier.")
+	flags.StringVar(&c.Warm, "warm", "", "Files to read into the cache at startup: a manifest (one path or glob per line), a previous access log, or a glob.")
+	flags.IntVar(&c.WarmConcurrency, "warm-concurrency", 8, "Number of files read at once by the -warm warm-up.")
+	flags.BoolVar(&c.WarmWait, "warm-wait", false, "Answer 503 on /ready until the -warm warm-up is done.")
+	flags.BoolVar(&c.Logging, "l", false, "Log debugging messages.")
+}
+
+/**
+ * Builds the settings from a config file on top of the flag values. The flags that
+ * were given on the command line (explicit) keep their value. The format comes from
+ * the file extension, unknown keys are an error.
+ */
+func loadConfig(filename string, flagValues *config, explicit map[string]bool) (*config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the config: %v", err)
+	}
+	c := *flagValues
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&c)
+	case ".toml":
+		var meta toml.MetaData
+		if meta, err = toml.Decode(string(data), &c); err == nil && len(meta.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown setting '%v'", meta.Undecoded()[0])
+		}
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(&c); err == io.EOF {
+			err = nil // An empty file.
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown config format (expected .json, .toml, .yaml or .yml)", filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	c.keepFlags(flagValues, explicit)
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return &c, nil
+}
+
+/**
+ * Copies the explicit flags (by name) from flagValues.
+ */
+func (c *config) keepFlags(flagValues *config, explicit map[string]bool) {
+	fields := reflect.TypeOf(*c)
+	for i := 0; i < fields.NumField(); i++ {
+		if name := fields.Field(i).Tag.Get("flag"); name != "" && explicit[name] {
+			reflect.ValueOf(c).Elem().Field(i).Set(reflect.ValueOf(flagValues).Elem().Field(i))
+		}
+	}
+}
+
+/**
+ * Checks the settings that can be checked without touching anything. The errors name
+ * the setting by its config key.
+ */
+func (c *config) validate() error {
+	switch {
+	case c.Port < 1 || c.Port > 65535:
+		return fmt.Errorf("port: %v is not a port number (1 to 65535)", c.Port)
+	case c.Capacity < 0:
+		return fmt.Errorf("capacity: must not be negative (got %v)", c.Capacity)
+	case c.Timeout < 0:
+		return fmt.Errorf("timeout: must not be negative (got %v)", c.Timeout)
+	case c.TimeoutMs < 0:
+		return fmt.Errorf("timeout_ms: must not be negative (got %v)", c.TimeoutMs)
+	case c.AccessLogFormat != "combined" && c.AccessLogFormat != "json":
+		return fmt.Errorf("access_log_format: unknown format '%s' (expected combined or json)", c.AccessLogFormat)
+	case c.AccessLogMaxBytes < 0:
+		return fmt.Errorf("access_log_max_bytes: must not be negative (got %v)", c.AccessLogMaxBytes)
+	case c.AccessLogMaxAge < 0:
+		return fmt.Errorf("access_log_max_age: must not be negative (got %v)", time.Duration(c.AccessLogMaxAge))
+	case (c.TLSCert == "") != (c.TLSKey == ""):
+		return fmt.Errorf("tls_cert and tls_key: TLS needs both a certificate and a key file")
+	case c.TLSRedirect != 0 && c.TLSCert == "":
+		return fmt.Errorf("tls_redirect: needs tls_cert and tls_key")
+	case c.TLSRedirect < 0 || c.TLSRedirect > 65535:
+		return fmt.Errorf("tls_redirect: %v is not a port number (1 to 65535)", c.TLSRedirect)
+	case c.Drain < 0:
+		return fmt.Errorf("drain: must not be negative (got %v)", time.Duration(c.Drain))
+	case c.TTL < 0:
+		return fmt.Errorf("ttl: must not be negative (got %v)", time.Duration(c.TTL))
+	case c.StaleRevalidate < 0:
+		return fmt.Errorf("stale_while_revalidate: must not be negative (got %v)", time.Duration(c.StaleRevalidate))
+	case c.StaleIfError < 0:
+		return fmt.Errorf("stale_if_error: must not be negative (got %v)", time.Duration(c.StaleIfError))
+	case c.Stream < 0:
+		return fmt.Errorf("stream: must not be negative (got %v)", c.Stream)
+	case c.Mmap < 0:
+		return fmt.Errorf("mmap: must not be negative (got %v)", c.Mmap)
+	case c.DiskCacheCapacity <= 0:
+		return fmt.Errorf("disk_cache_capacity: must be positive (got %v)", c.DiskCacheCapacity)
+	case c.WarmConcurrency < 1:
+		return fmt.Errorf("warm_concurrency: must be at least 1 (got %v)", c.WarmConcurrency)
+	}
+	if err := validateTTLRules(c.TTLRules); err != nil {
+		return err
+	}
+	if err := cache.CheckEvictionPolicy(c.Eviction); err != nil {
+		return fmt.Errorf("eviction: %v", err)
+	}
+	for i, rule := range c.Headers {
+		if _, err := path.Match(rule.Path, ""); err != nil || !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("headers[%v]: bad path glob '%s' (expected e.g. \"/static/*.js\")", i, rule.Path)
+		}
+		if len(rule.Set) == 0 {
+			return fmt.Errorf("headers[%v]: no headers to set for '%s'", i, rule.Path)
+		}
+		for name := range rule.Set {
+			if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+				return fmt.Errorf("headers[%v]: bad header name '%s'", i, name)
+			}
+		}
+	}
+	return nil
+}
+
+/**
+ * Keys (see the json tags) of the settings that differ between c and other, either the
+ * live ones or the ones that need a restart.
+ */
+func (c *config) changedKeys(other *config, live bool) []string {
+	var keys []string
+	fields := reflect.TypeOf(*c)
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Field(i)
+		if (field.Tag.Get("live") == "true") != live {
+			continue
+		}
+		if !reflect.DeepEqual(reflect.ValueOf(*c).Field(i).Interface(), reflect.ValueOf(*other).Field(i).Interface()) {
+			keys = append(keys, field.Tag.Get("json"))
+		}
+	}
+	return keys
+}
+
+/**
+ * The timeout for cache misses, timeout_ms wins over timeout when it is set.
+ */
+func (c *config) cacheTimeout() time.Duration {
+	if c.TimeoutMs > 0 {
+		return time.Millisecond * time.Duration(c.TimeoutMs)
+	}
+	return time.Second * time.Duration(c.Timeout)
+}
+
+/**
+ * Sets the server globals from the settings, at startup.
+ */
+func (c *config) apply() {
+	port = c.Port
+	capacity = c.Capacity
+	timeout = c.Timeout
+	timeoutMs = c.TimeoutMs
+	cancelReads = c.CancelReads
+	workingDir = c.Dir
+	evictionPolicy = c.Eviction
+	watchFiles = c.Watch
+	accessLogPath = c.AccessLog
+	accessLogFormat = c.AccessLogFormat
+	accessLogMaxBytes = c.AccessLogMaxBytes
+	accessLogMaxAge = time.Duration(c.AccessLogMaxAge)
+	adminTokenFile = c.AdminToken
+	adminPasswordFile = c.AdminPasswd
+	adminAllowList = c.AdminAllow
+	adminAddr = c.AdminAddr
+	tlsCertFile = c.TLSCert
+	tlsKeyFile = c.TLSKey
+	tlsRedirectPort = c.TLSRedirect
+	drainTimeout = time.Duration(c.Drain)
+	staleWhileRevalidate = time.Duration(c.StaleRevalidate)
+	staleIfError = time.Duration(c.StaleIfError)
+	streamThreshold = c.Stream
+	mmapSize = c.Mmap
+	diskCacheDir = c.DiskCache
+	diskCacheCapacity = c.DiskCacheCapacity
+	warmSource = c.Warm
+	warmConcurrency = c.WarmConcurrency
+	warmWait = c.WarmWait
+	setTTLs(time.Duration(c.TTL), c.TTLRules)
+	setLogging(c.Logging)
+	setHeaderRules(c.Headers)
+}
+
+/**
+ * Reloads the config file (e.g. on SIGHUP). The live settings (capacity, timeouts,
+ * TTLs, logging and headers) apply right away, the capacity through a cache resize. A reload
+ * that changes any other setting is rejected as a whole and nothing changes.
+ */
+type configReloader struct {
+	mutex      sync.Mutex
+	filename   string
+	flagValues *config
+	explicit   map[string]bool
+	active     *config
+}
+
+func (r *configReloader) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	c, err := loadConfig(r.filename, r.flagValues, r.explicit)
+	if err != nil {
+		return err
+	}
+	if static := c.changedKeys(r.active, false); len(static) > 0 {
+		return fmt.Errorf("%s: rejected the reload, changing %v needs a restart", r.filename, strings.Join(static, ", "))
+	}
+	changed := c.changedKeys(r.active, true)
+	if c.Capacity != r.active.Capacity {
+		cache.ReleaseFiles(fileCache.Resize(c.Capacity))
+	}
+	if c.cacheTimeout() != r.active.cacheTimeout() {
+		fileCache.SetTimeout(c.cacheTimeout())
+	}
+	setTTLs(time.Duration(c.TTL), c.TTLRules)
+	setLogging(c.Logging)
+	setHeaderRules(c.Headers)
+	r.active = c
+	log.Printf("Reloaded %s, changed: %v", r.filename, changed)
+	return nil
+}
+
+/**
+ * Reloads the config every time the process gets a SIGHUP.
+ */
+func (r *configReloader) reloadOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := r.Reload(); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}
+
+/**
+ * The header rules in use, swapped as a whole on a reload.
+ */
+var headerRules atomic.Value // []headerRule
+
+func setHeaderRules(rules []headerRule) {
+	headerRules.Store(rules)
+}
+
+/**
+ * Sets the headers of every rule whose glob matches the (resolved) filename. Only the
+ * responses that serve the file get them (see statusRecorder.begin).
+ */
+func applyHeaderRules(w http.ResponseWriter, filename string) {
+	rules, _ := headerRules.Load().([]headerRule)
+	urlPath := "/" + strings.TrimPrefix(filename, "./")
+	for _, rule := range rules {
+		if matched, _ := path.Match(rule.Path, urlPath); matched {
+			for name, value := range rule.Set {
+				w.Header().Set(name, value)
+			}
+		}
+	}
+}
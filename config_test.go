@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ *	The flag values (defaults plus the given command line) and the explicit flags.
+ */
+func parseTestFlags(args []string, t *testing.T) (*config, map[string]bool) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	values := &config{}
+	registerFlags(flags, values)
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	return values, explicit
+}
+
+func writeConfig(dir, name, content string, t *testing.T) string {
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// ============ Config Tests ============
+
+func TestConfigFormats(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"server.json": `{"port": 9000, "capacity": 5000, "eviction": "lru", "drain": "1m", "logging": true,
+			"headers": [{"path": "/static/*", "set": {"Cache-Control": "max-age=60"}}]}`,
+		"server.toml": "port = 9000\ncapacity = 5000\neviction = \"lru\"\ndrain = \"1m\"\nlogging = true\n\n" +
+			"[[headers]]\npath = \"/static/*\"\n[headers.set]\nCache-Control = \"max-age=60\"\n",
+		"server.yaml": "port: 9000\ncapacity: 5000\neviction: lru\ndrain: 1m\nlogging: true\n" +
+			"headers:\n  - path: /static/*\n    set:\n      Cache-Control: max-age=60\n",
+	}
+	defaults, explicit := parseTestFlags(nil, t)
+	expected := *defaults
+	expected.Port = 9000
+	expected.Capacity = 5000
+	expected.Eviction = "lru"
+	expected.Drain = configDuration(time.Minute)
+	expected.Logging = true
+	expected.Headers = []headerRule{{"/static/*", map[string]string{"Cache-Control": "max-age=60"}}}
+	for name, content := range files {
+		loaded, err := loadConfig(writeConfig(dir, name, content, t), defaults, explicit)
+		if err != nil {
+			t.Errorf("Could not load (%s): %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*loaded, expected) {
+			t.Errorf("Wrong settings from (%s)! Expected: (%+v), Actual: (%+v)", name, expected, *loaded)
+		}
+	}
+	// An empty file keeps the flag values.
+	if loaded, err := loadConfig(writeConfig(dir, "empty.yml", "", t), defaults, explicit); err != nil || !reflect.DeepEqual(loaded, defaults) {
+		t.Errorf("An empty config changed the settings! Actual: (%+v, %v)", loaded, err)
+	}
+}
+
+func TestConfigExplicitFlags(t *testing.T) {
+	dir := t.TempDir()
+	filename := writeConfig(dir, "server.json", `{"port": 9000, "capacity": 5000, "timeout": 5}`, t)
+	flagValues, explicit := parseTestFlags([]string{"-c", "700", "-t", "2"}, t)
+	loaded, err := loadConfig(filename, flagValues, explicit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Port != 9000 || loaded.Capacity != 700 || loaded.Timeout != 2 {
+		t.Errorf("The command line flags should win over the file! Expected: (9000, 700, 2), Actual: (%v, %v, %v)",
+			loaded.Port, loaded.Capacity, loaded.Timeout)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	defaults, explicit := parseTestFlags(nil, t)
+	bad := []struct{ name, content, message string }{
+		{"unknown.json", `{"capacity": 10, "capcity": 10}`, "capcity"},
+		{"unknown.toml", "capcity = 10\n", "capcity"},
+		{"unknown.yaml", "capcity: 10\n", "capcity"},
+		{"syntax.json", `{"capacity": }`, "syntax.json"},
+		{"type.yaml", "capacity: lots\n", "line 1"},
+		{"negative.json", `{"capacity": -1}`, "capacity"},
+		{"port.toml", "port = 70000\n", "port"},
+		{"eviction.yaml", "eviction: fifo\n", "eviction"},
+		{"duration.json", `{"drain": "soon"}`, "soon"},
+		{"format.json", `{"access_log_format": "xml"}`, "access_log_format"},
+		{"tls.json", `{"tls_cert": "cert.pem"}`, "tls_key"},
+		{"redirect.json", `{"tls_redirect": 80}`, "tls_redirect"},
+		{"disk.yaml", "disk_cache: l2\ndisk_cache_capacity: 0\n", "disk_cache_capacity"},
+		{"glob.json", `{"headers": [{"path": "/static/[", "set": {"X-A": "b"}}]}`, "headers[0]"},
+		{"header.yaml", "headers:\n  - path: /*\n    set:\n      'Bad Name': x\n", "Bad Name"},
+		{"server.ini", "port = 9000\n", "unknown config format"},
+	}
+	for _, test := range bad {
+		_, err := loadConfig(writeConfig(dir, test.name, test.content, t), defaults, explicit)
+		if err == nil {
+			t.Errorf("A bad config was accepted! (%s)", test.name)
+		} else if !strings.Contains(err.Error(), test.message) {
+			t.Errorf("The error for (%s) should mention (%s)! Actual: (%v)", test.name, test.message, err)
+		}
+	}
+	if _, err := loadConfig(filepath.Join(dir, "missing.json"), defaults, explicit); err == nil {
+		t.Errorf("A missing config was accepted!")
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 30
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	defer setHeaderRules(nil)
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		data = []byte(fmt.Sprintf("FID:%v", filename[2:]))
+		return
+	})
+	dir := t.TempDir()
+	flagValues, explicit := parseTestFlags(nil, t)
+	filename := writeConfig(dir, "server.yaml", "capacity: 30\ntimeout: 2\n", t)
+	active, err := loadConfig(filename, flagValues, explicit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader := &configReloader{filename: filename, flagValues: flagValues, explicit: explicit, active: active}
+	for _, name := range []string{"/a.html", "/b.html", "/c.html"} {
+		requestFile(name, secTimeout, t)
+	}
+	validateCacheSize(3, 30, t)
+
+	// The live settings apply without a restart, and the cache is resized, not cleared.
+	writeConfig(dir, "server.yaml", "capacity: 20\ntimeout_ms: 500\nlogging: true\n"+
+		"headers:\n  - path: /*.html\n    set:\n      Cache-Control: max-age=60\n", t)
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Could not reload the live settings: %v", err)
+	}
+	if stats := fileCache.Stats(); stats.Capacity != 20 || stats.Items != 2 || stats.BytesUsed != 20 {
+		t.Errorf("The capacity was not changed live! Expected: (capacity 20, 2 items, 20 bytes), Actual: (%v, %v, %v)",
+			stats.Capacity, stats.Items, stats.BytesUsed)
+	}
+	if isLogging != 1 {
+		t.Errorf("The logging was not turned on by the reload!")
+	}
+	setLogging(false) // Keep the test output quiet.
+	resp := requestFile("/a.html", secTimeout, t)
+	if resp.header.Get("Cache-Control") != "max-age=60" {
+		t.Errorf("The headers were not applied! Actual: (%v)", resp.header)
+	}
+	if resp := requestFile("/a.txt", secTimeout, t); resp.header.Get("Cache-Control") != "" {
+		t.Errorf("The headers were applied to a path that does not match! Actual: (%v)", resp.header)
+	}
+
+	// A reload that changes a setting that needs a restart changes nothing at all.
+	writeConfig(dir, "server.yaml", "capacity: 10\nport: 9000\ndir: /srv\n", t)
+	err = reloader.Reload()
+	if err == nil || !strings.Contains(err.Error(), "port, dir") {
+		t.Errorf("A reload changing the port and dir should have been rejected! Actual: (%v)", err)
+	}
+	if stats := fileCache.Stats(); stats.Capacity != 20 {
+		t.Errorf("A rejected reload changed the capacity! Actual: (%v)", stats.Capacity)
+	}
+	// So does a broken file.
+	writeConfig(dir, "server.yaml", "capacity: -10\n", t)
+	if err := reloader.Reload(); err == nil {
+		t.Errorf("A broken config was reloaded!")
+	}
+	if reloader.active.Capacity != 20 {
+		t.Errorf("A failed reload replaced the active settings!")
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestConfigHeaderRulesOnErrors(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	setHeaderRules([]headerRule{{"/*", map[string]string{"Cache-Control": "max-age=60"}}})
+	defer setHeaderRules(nil)
+	// We set the userlib FileRead function to this custom 'read', which only knows "/a.html".
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		if filename != "./a.html" {
+			return nil, errors.New("no such file")
+		}
+		return []byte("FID:a.html"), nil
+	})
+
+	// The responses that serve the file get the headers, errors don't.
+	resp := requestFile("/a.html", secTimeout, t)
+	etag := resp.header.Get("ETag")
+	requests := []*http.Request{
+		genConditionalRequest("/a.html", "Range", "bytes=0-1"),
+		genConditionalRequest("/a.html", "If-None-Match", etag),
+		genRequestUrl("/missing.html"),
+		genConditionalRequest("/a.html", "Range", "bytes=100-"),
+	}
+	statuses := []int{http.StatusPartialContent, http.StatusNotModified, userlib.FILEERRORCODE,
+		http.StatusRequestedRangeNotSatisfiable}
+	expected := []string{"max-age=60", "max-age=60", "", ""}
+	if resp.header.Get("Cache-Control") != "max-age=60" {
+		t.Errorf("The headers were not applied to the file! Actual: (%v)", resp.header)
+	}
+	for i, req := range requests {
+		resp := genResponseTestWriter()
+		handler(resp, req)
+		if resp.statusCode != statuses[i] || resp.header.Get("Cache-Control") != expected[i] {
+			t.Errorf("Wrong headers for a %v! Expected: (%v, %q), Actual: (%v, %v)",
+				statuses[i], statuses[i], expected[i], resp.statusCode, resp.header)
+		}
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+// ============ End of Config Tests ============
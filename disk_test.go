@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ============ Disk Cache Tests ============
+
+func TestDiskCacheTier(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = t.TempDir() + "/"
+	diskCacheDir = t.TempDir()
+	defer func() {
+		workingDir = ""
+		diskCacheDir = ""
+		launchCache()
+	}()
+	launchCache()
+	reads := uint64(0)
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		atomic.AddUint64(&reads, 1)
+		return ioutil.ReadFile(workingDir + filename)
+	})
+	data := writeLargeFile(workingDir, "file.txt", 100, t)
+
+	// A file still cached at shutdown is kept on the disk tier, a restart loads it back into memory.
+	requestFile("/file.txt", secTimeout, t)
+	for i := 0; i < 2; i++ {
+		launchCache()
+		// Preloaded in the background.
+		for deadline := time.Now().Add(time.Second); fileCache.Stats().Items == 0 && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		if resp := requestFile("/file.txt", secTimeout, t); validateFileResponse("", "", data, resp, userlib.SUCCESSCODE, t) {
+			t.Errorf("Could not serve the file from the disk tier!")
+		}
+	}
+	if reads != 1 {
+		t.Errorf("The file should only have been read once! Actual reads: (%v)", reads)
+	}
+	if stats := fileCache.Stats(); stats.DiskItems != 1 || stats.DiskBytesUsed != int64(len(data)) {
+		t.Errorf("Wrong disk stats! Expected: (1 item, %v bytes), Actual: (%v, %v)",
+			len(data), stats.DiskItems, stats.DiskBytesUsed)
+	}
+	// A clear empties both tiers (the disk one in the background).
+	if resp := requestMethod(http.MethodPost, "/cache/clear/"); resp.statusCode != userlib.SUCCESSCODE {
+		t.Errorf("Could not clear the cache! Status: (%v)", resp.statusCode)
+	}
+	for deadline := time.Now().Add(time.Second); fileCache.Stats().DiskItems != 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	requestFile("/file.txt", secTimeout, t)
+	if reads != 2 {
+		t.Errorf("The cleared file should have been read again! Actual reads: (%v)", reads)
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+// ============ End of Disk Cache Tests ============
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// ============ Eviction Policy Tests ============
+
+func TestEvictionPolicyLRUKeepsHotFile(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 20
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	evictionPolicy = "lru"
+	launchCache()
+	hotName := "/hot"
+	var hotReads uint64 = 0
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		if filename == "."+hotName {
+			atomic.AddUint64(&hotReads, 1)
+		}
+		data = []byte(fmt.Sprintf("FID:%v", filename[2:]))
+		return
+	})
+	// The hot file is 7 bytes and every cold file is 5, so only two cold files fit next to it.
+	for i := 0; i < 100; i++ {
+		resp := requestFile(hotName, secTimeout, t)
+		if validateFileResponse("", "", []byte("FID:hot"), resp, userlib.SUCCESSCODE, t) == true {
+			t.FailNow()
+		}
+		fid := fmt.Sprintf("%v", i%10)
+		resp = requestFile("/"+fid, secTimeout, t)
+		if validateFileResponse("", "", []byte("FID:"+fid), resp, userlib.SUCCESSCODE, t) == true {
+			t.FailNow()
+		}
+		if validateCacheNotExceeded(t) == true {
+			t.FailNow()
+		}
+	}
+	validateNumberOfReads(1, hotReads, t)
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	evictionPolicy = "random"
+	clearCache()
+}
+
+// ============ End of Eviction Policy Tests ============
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/**
+ * Methods for reading files (and cache information), and for changing the cache.
+ */
+var (
+	readMethods  = []string{http.MethodGet, http.MethodHead}
+	adminMethods = []string{http.MethodPost, http.MethodDelete}
+)
+
+/**
+ * Wraps a handler so that it only serves the given methods. Anything else gets a
+ * 405 Method Not Allowed with an Allow header. An empty method is a GET, like it is
+ * for client requests.
+ */
+func allowMethods(h http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		method := r.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+		for _, allowed := range methods {
+			if method == allowed {
+				h(w, r)
+				return
+			}
+		}
+		debugLog(fmt.Sprintf("<< [ERROR] Method not allowed: %v '%v'", method, r.URL.Path))
+		w.Header().Set("Allow", allow)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+/**
+ * Whether a request only wants the headers of the response (HEAD).
+ */
+func isHead(r *http.Request) bool {
+	return r.Method == http.MethodHead
+}
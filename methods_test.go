@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+/*
+ *	Sends a request with the given method through the server's routes.
+ */
+func requestMethod(method, urlpath string) *ResponseWriterTester {
+	resp := genResponseTestWriter()
+	req := genRequestUrl(urlpath)
+	req.Method = method
+	newServeMux(true, true).ServeHTTP(resp, req)
+	return resp
+}
+
+func validateNotAllowed(resp *ResponseWriterTester, allow string, t *testing.T) (failed bool) {
+	if resp.statusCode != http.StatusMethodNotAllowed {
+		failed = true
+		t.Errorf("Received the wrong status code! Expected: (%v), Actual: (%v)", http.StatusMethodNotAllowed, resp.statusCode)
+	}
+	if resp.header.Get("Allow") != allow {
+		failed = true
+		t.Errorf("Wrong Allow header! Expected: (%s), Actual: (%s)", allow, resp.header.Get("Allow"))
+	}
+	return failed
+}
+
+// ============ Method Tests ============
+
+func TestMethodsFiles(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	name := "/index.html"
+	dataToBeRead := []byte("<html>CS61C is the best class in the world!</html>")
+	var reads uint64 = 0
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		atomic.AddUint64(&reads, 1)
+		if filename != "."+name {
+			return nil, fmt.Errorf("the file does not exist")
+		}
+		data = dataToBeRead
+		return
+	})
+	// HEAD sends the headers only, and still goes through the cache.
+	for i := 0; i < 2; i++ {
+		resp := requestMethod(http.MethodHead, name)
+		validateFileResponse("."+name, "."+name, []byte{}, resp, userlib.SUCCESSCODE, t)
+		if resp.header.Get("Content-Length") != strconv.Itoa(len(dataToBeRead)) {
+			t.Errorf("Wrong Content-Length! Expected: (%v), Actual: (%s)", len(dataToBeRead), resp.header.Get("Content-Length"))
+		}
+		if resp.header.Get("ETag") == "" {
+			t.Errorf("A HEAD response should have the same headers as a GET!")
+		}
+	}
+	resp := requestMethod(http.MethodGet, name)
+	validateFileResponse("."+name, "."+name, dataToBeRead, resp, userlib.SUCCESSCODE, t)
+	validateNumberOfReads(1, reads, t)
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch, http.MethodOptions} {
+		resp := requestMethod(method, name)
+		validateNotAllowed(resp, "GET, HEAD", t)
+	}
+	validateNumberOfReads(1, reads, t)
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestMethodsCacheAdmin(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		data = []byte(fmt.Sprintf("FID:%v", filename[2:]))
+		return
+	})
+	requestFile("/a.html", secTimeout, t)
+	requestFile("/b.html", secTimeout, t)
+	// Crawlers following links must not change the cache.
+	for _, url := range []string{"/cache/clear/", "/cache/evict/a.html", "/cache/evict-prefix/"} {
+		for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPut} {
+			validateNotAllowed(requestMethod(method, url), "POST, DELETE", t)
+		}
+	}
+	validateCacheSize(2, 20, t)
+	// Reading cache information is fine, changing it is not.
+	for _, url := range []string{"/cache/", "/cache/stats.json", "/metrics"} {
+		if resp := requestMethod(http.MethodGet, url); resp.statusCode != userlib.SUCCESSCODE {
+			t.Errorf("Could not GET (%s)! Status: (%v)", url, resp.statusCode)
+		}
+		validateNotAllowed(requestMethod(http.MethodPost, url), "GET, HEAD", t)
+	}
+	resp := requestMethod(http.MethodDelete, "/cache/evict/a.html")
+	if resp.statusCode != userlib.SUCCESSCODE {
+		t.Errorf("Could not DELETE a file from the cache! Status: (%v)", resp.statusCode)
+	}
+	validateCacheSize(1, 10, t)
+	resp = requestMethod(http.MethodPost, "/cache/clear/")
+	if resp.statusCode != userlib.SUCCESSCODE {
+		t.Errorf("Could not clear the cache! Status: (%v)", resp.statusCode)
+	}
+	validateCacheSize(0, 0, t)
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+// ============ End of Method Tests ============
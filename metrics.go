@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * Prometheus metrics served on /metrics in the text exposition format. The cache
+ * counters and gauges come from the cache (see cache.Stats), the request
+ * counters and latency histograms are updated by the request threads.
+ */
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+/**
+ * A cumulative histogram (in seconds) that is safe to observe from any thread.
+ */
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // Per bucket (not cumulative), the last one is +Inf.
+	sumNano uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets, make([]uint64, len(buckets)+1), 0}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(h.buckets, d.Seconds()) // First bucket with le >= d.
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sumNano, uint64(d.Nanoseconds()))
+}
+
+func (h *histogram) write(buf *bytes.Buffer, name, help string) {
+	writeMetricHeader(buf, name, help, "histogram")
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(buf, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(le), cumulative)
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.buckets)])
+	fmt.Fprintf(buf, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(buf, "%s_sum %s\n", name, formatFloat(float64(atomic.LoadUint64(&h.sumNano))/1e9))
+	fmt.Fprintf(buf, "%s_count %d\n", name, cumulative)
+}
+
+var (
+	handlerLatency  = newHistogram(latencyBuckets)
+	diskReadLatency = newHistogram(latencyBuckets)
+	requestsMutex   sync.Mutex
+	requestsByCode  = make(map[int]uint64)
+)
+
+/**
+ * Records a finished file request.
+ */
+func observeRequest(statusCode int, duration time.Duration) {
+	requestsMutex.Lock()
+	requestsByCode[statusCode]++
+	requestsMutex.Unlock()
+	handlerLatency.observe(duration)
+}
+
+/**
+ * Response writer that remembers the status code, the number of bytes sent and
+ * whether the file came from the cache, so the request can be counted and logged.
+ * It also applies the header rules of the requested file, once the response turns out
+ * to serve it.
+ */
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	bytes    int
+	cache    string // HIT, MISS, STALE or STREAM for file requests, empty otherwise.
+	filename string // The file whose header rules go on the response (see applyHeaderRules).
+}
+
+/**
+ * Wraps a response writer in a statusRecorder (unless it already is one).
+ */
+func recordResponse(w http.ResponseWriter) *statusRecorder {
+	if recorder, ok := w.(*statusRecorder); ok {
+		return recorder
+	}
+	return &statusRecorder{ResponseWriter: w}
+}
+
+/**
+ * Records the status of the response, right before its header is sent. Only the
+ * responses that serve the file (200, 206 and 304) get its header rules, errors don't.
+ */
+func (r *statusRecorder) begin(statusCode int) {
+	if r.status != 0 {
+		return
+	}
+	r.status = statusCode
+	switch statusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusNotModified:
+		if r.filename != "" {
+			applyHeaderRules(r.ResponseWriter, r.filename)
+		}
+	}
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	r.begin(statusCode)
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	r.begin(http.StatusOK)
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += n
+	return n, err
+}
+
+/**
+ * Hands io.Copy (e.g. from a streamed file) down to the connection, so it can sendfile.
+ */
+func (r *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.begin(http.StatusOK)
+	var n int64
+	var err error
+	if readerFrom, ok := r.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = readerFrom.ReadFrom(src)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{r.ResponseWriter}, src)
+	}
+	r.bytes += int(n)
+	return n, err
+}
+
+func (r *statusRecorder) statusCode() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name, help, kind string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeMetric(buf *bytes.Buffer, name, help, kind string, value float64) {
+	writeMetricHeader(buf, name, help, kind)
+	fmt.Fprintf(buf, "%s %s\n", name, formatFloat(value))
+}
+
+/**
+ * Writes every metric in the Prometheus text exposition format.
+ */
+func writeMetrics(buf *bytes.Buffer) {
+	requestsMutex.Lock()
+	codes := make([]int, 0, len(requestsByCode))
+	for code := range requestsByCode {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	writeMetricHeader(buf, "fileserver_requests_total", "File requests by HTTP status code.", "counter")
+	for _, code := range codes {
+		fmt.Fprintf(buf, "fileserver_requests_total{code=\"%d\"} %d\n", code, requestsByCode[code])
+	}
+	requestsMutex.Unlock()
+
+	stats := fileCache.StatsTop(0)
+	writeMetric(buf, "fileserver_cache_hits_total", "Cache hits.", "counter", float64(stats.Hits))
+	writeMetric(buf, "fileserver_cache_misses_total", "Cache misses.", "counter", float64(stats.Misses))
+	writeMetric(buf, "fileserver_cache_stale_hits_total", "Expired files served while revalidating, or after a failed read.", "counter", float64(stats.StaleHits))
+	writeMetric(buf, "fileserver_cache_evictions_total", "Files evicted to make room in the cache.", "counter", float64(stats.Evictions))
+	writeMetric(buf, "fileserver_cache_bytes_used", "Bytes of file data in the cache.", "gauge", float64(stats.BytesUsed))
+	writeMetric(buf, "fileserver_cache_capacity_bytes", "Capacity of the cache in bytes.", "gauge", float64(stats.Capacity))
+	writeMetric(buf, "fileserver_cache_disk_hits_total", "Misses served from the disk cache tier.", "counter", float64(stats.DiskHits))
+	writeMetric(buf, "fileserver_cache_disk_bytes_used", "Bytes of file data in the disk cache tier.", "gauge", float64(stats.DiskBytesUsed))
+	writeMetric(buf, "fileserver_cache_mapped_bytes", "Bytes of memory-mapped files, including evicted ones still being sent.", "gauge", float64(stats.MappedBytes))
+
+	handlerLatency.write(buf, "fileserver_handler_duration_seconds", "Time taken to answer file requests.")
+	diskReadLatency.write(buf, "fileserver_disk_read_duration_seconds", "Time taken to read files from disk on a cache miss.")
+}
+
+/**
+ * The handler for Prometheus metrics.
+ */
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ *	Parses the text exposition format into a map of 'name{labels}' to value.
+ */
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	resp := genResponseTestWriter()
+	metricsHandler(resp, genRequestUrl("/metrics"))
+	if !strings.HasPrefix(resp.header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Wrong content type for the metrics: (%s)", resp.header.Get("Content-Type"))
+	}
+	metrics := make(map[string]float64)
+	for _, line := range strings.Split(strings.TrimSpace(string(resp.data)), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		space := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[space+1:], 64)
+		if space < 0 || err != nil {
+			t.Fatalf("Could not parse the metric line: (%s)", line)
+		}
+		metrics[line[:space]] = value
+	}
+	return metrics
+}
+
+func validateMetricDelta(name string, before, after map[string]float64, expected float64, t *testing.T) (failed bool) {
+	if after[name]-before[name] != expected {
+		failed = true
+		t.Errorf("The metric %s is wrong! Expected it to go up by (%v), Actual: (%v)", name, expected, after[name]-before[name])
+	}
+	return failed
+}
+
+// ============ Metrics Tests ============
+
+func TestMetricsHistogramFormat(t *testing.T) {
+	h := newHistogram([]float64{0.01, 0.1, 1})
+	h.observe(5 * time.Millisecond)
+	h.observe(10 * time.Millisecond) // Buckets are inclusive.
+	h.observe(50 * time.Millisecond)
+	h.observe(2 * time.Second)
+	var buf bytes.Buffer
+	h.write(&buf, "test_seconds", "A test histogram.")
+	expected := `# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.01"} 2
+test_seconds_bucket{le="0.1"} 3
+test_seconds_bucket{le="1"} 3
+test_seconds_bucket{le="+Inf"} 4
+test_seconds_sum 2.065
+test_seconds_count 4
+`
+	if buf.String() != expected {
+		t.Errorf("Wrong histogram output! Expected:\n%s\nActual:\n%s", expected, buf.String())
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 12
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		if filename == "./missing.html" {
+			err = fmt.Errorf("the file does not exist")
+		}
+		data = []byte(fmt.Sprintf("FID:%v", filename[2:]))
+		return
+	})
+	before := scrapeMetrics(t)
+	for _, name := range []string{"/a", "/a", "/b", "/c"} { // The third file evicts one.
+		requestFile(name, secTimeout, t)
+	}
+	validateBadFile("/missing.html", secTimeout, t)
+	after := scrapeMetrics(t)
+	validateMetricDelta(`fileserver_requests_total{code="200"}`, before, after, 4, t)
+	validateMetricDelta(fmt.Sprintf(`fileserver_requests_total{code="%d"}`, userlib.FILEERRORCODE), before, after, 1, t)
+	validateMetricDelta("fileserver_cache_hits_total", before, after, 1, t)
+	validateMetricDelta("fileserver_cache_misses_total", before, after, 4, t)
+	validateMetricDelta("fileserver_cache_evictions_total", before, after, 1, t)
+	validateMetricDelta(`fileserver_handler_duration_seconds_bucket{le="+Inf"}`, before, after, 5, t)
+	validateMetricDelta("fileserver_handler_duration_seconds_count", before, after, 5, t)
+	validateMetricDelta("fileserver_disk_read_duration_seconds_count", before, after, 4, t)
+	if after["fileserver_cache_bytes_used"] != 10 {
+		t.Errorf("Wrong number of bytes used! Expected: (10), Actual: (%v)", after["fileserver_cache_bytes_used"])
+	}
+	if after["fileserver_cache_capacity_bytes"] != float64(secCap) {
+		t.Errorf("Wrong capacity! Expected: (%v), Actual: (%v)", secCap, after["fileserver_cache_capacity_bytes"])
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+// ============ End of Metrics Tests ============
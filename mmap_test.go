@@ -0,0 +1,155 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"bytes"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// ============ Mmap Tests ============
+
+func TestMmapLargeFiles(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 100000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = t.TempDir() + "/"
+	mmapSize = 1000
+	defer func() {
+		workingDir = ""
+		mmapSize = 0
+		launchCache()
+	}()
+	launchCache()
+	// Mapped files don't go through the read function, the small ones still do.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		return ioutil.ReadFile(workingDir + filename)
+	})
+	big := writeLargeFile(workingDir, "big.txt", 64*1024, t) // Many pages, even on 16K page systems.
+	small := writeLargeFile(workingDir, "small.txt", 100, t)
+
+	for i := 0; i < 2; i++ { // A miss, then a hit.
+		if resp := requestFile("/big.txt", secTimeout, t); validateFileResponse("", "", big, resp, userlib.SUCCESSCODE, t) {
+			t.Errorf("Could not serve the mapped file!")
+		}
+	}
+	if resp := requestFile("/small.txt", secTimeout, t); validateFileResponse("", "", small, resp, userlib.SUCCESSCODE, t) {
+		t.Errorf("Could not serve the small file!")
+	}
+	// Ranges are cut out of the mapped data.
+	req := genRequestUrl("/big.txt")
+	req.Header = http.Header{"Range": {"bytes=40000-40009"}}
+	resp := genResponseTestWriter()
+	handler(resp, req)
+	if resp.statusCode != http.StatusPartialContent || !bytes.Equal(resp.data, big[40000:40010]) {
+		t.Errorf("Wrong range of a mapped file! Actual: (%v, %s)", resp.statusCode, resp.data)
+	}
+	if stats := fileCache.Stats(); stats.MappedBytes != int64(len(big)) || stats.BytesUsed != len(big)+len(small) {
+		t.Errorf("Wrong stats! Expected: (%v mapped, %v used), Actual: (%v, %v)",
+			len(big), len(big)+len(small), stats.MappedBytes, stats.BytesUsed)
+	}
+	// Truncated in place, the response that reads past its new end is cut off and the
+	// mapping dropped, the next one reads the file again.
+	changed := writeLargeFile(workingDir, "big.txt", 2000, t)
+	func() {
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Errorf("The response should have been cut off! Actual: (%v)", r)
+			}
+		}()
+		handler(genResponseTestWriter(), genRequestUrl("/big.txt"))
+	}()
+	if resp := requestFile("/big.txt", secTimeout, t); validateFileResponse("", "", changed, resp, userlib.SUCCESSCODE, t) {
+		t.Errorf("Could not serve the file that changed under its mapping!")
+	}
+	// Every response is done, so the eviction unmaps it.
+	if resp := requestMethod(http.MethodPost, "/cache/evict/big.txt"); resp.statusCode != userlib.SUCCESSCODE {
+		t.Errorf("Could not evict the mapped file! Status: (%v)", resp.statusCode)
+	}
+	if mapped := fileCache.Stats().MappedBytes; mapped != 0 {
+		t.Errorf("The evicted file is still mapped! Actual: (%v bytes)", mapped)
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+/*
+ *	Keeps the slices it is handed, like the frame writer of HTTP/2 which sends them from
+ *	another goroutine.
+ */
+type retainingResponseWriter struct {
+	*ResponseWriterTester
+	writes [][]byte
+}
+
+func (r *retainingResponseWriter) Write(d []byte) (int, error) {
+	r.writes = append(r.writes, d)
+	return len(d), nil
+}
+
+func TestMmapCopiedForHTTP2(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = t.TempDir() + "/"
+	mmapSize = 1000
+	defer func() {
+		workingDir = ""
+		mmapSize = 0
+		launchCache()
+	}()
+	launchCache()
+	big := writeLargeFile(workingDir, "big.txt", 200*1024, t)
+	requestFile("/big.txt", secTimeout, t)
+	if stats := fileCache.Stats(); stats.MappedBytes != int64(len(big)) {
+		t.Fatalf("The file should have been mapped! Actual: (%v bytes mapped)", stats.MappedBytes)
+	}
+	for _, header := range []string{"", "bytes=1000-1999"} {
+		req := genRequestUrl("/big.txt")
+		req.ProtoMajor = 2
+		if header != "" {
+			req.Header = http.Header{"Range": {header}}
+		}
+		resp := &retainingResponseWriter{ResponseWriterTester: genResponseTestWriter()}
+		handler(resp, req)
+		expected := big
+		if header != "" {
+			expected = big[1000:2000]
+		}
+		// Rewritten in place (same size), the mapped pages now hold the new content.
+		if err := ioutil.WriteFile(workingDir+"big.txt", bytes.Repeat([]byte("x"), len(big)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if sent := bytes.Join(resp.writes, nil); !bytes.Equal(sent, expected) {
+			t.Errorf("The mapped data should have been copied before it was written! Range: (%v)", header)
+		}
+		writeLargeFile(workingDir, "big.txt", len(big), t)
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+// ============ End of Mmap Tests ============
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+var (
+	errBadPath     = errors.New("bad request path")
+	errOutsideRoot = errors.New("forbidden: the path resolves outside of the working dir")
+)
+
+/**
+ * HTTP status code for an error from resolveFilename, cleanPath or checkInsideRoot.
+ */
+func pathErrorCode(err error) int {
+	if err == errOutsideRoot {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+/**
+ * Turns an (escaped) request path into the filename that is read from the working dir,
+ * e.g. '/a/%2E%2E/b/' is './b/index.html'. It never touches the disk, the symlinks are
+ * only followed on a miss (see checkInsideRoot).
+ */
+func resolveFilename(rawPath string) (string, error) {
+	cleaned, err := cleanPath(rawPath)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(cleaned, "/") {
+		cleaned += "index.html"
+	}
+	return "./" + cleaned[1:], nil
+}
+
+/**
+ * Percent-decodes a request path and cleans it (path.Clean) into a rooted path. Both '/'
+ * and '\' are separators and '..' stops at the root. A path that names a directory
+ * (ends in '/', '.' or '..') keeps a trailing '/'. Empty paths, bad escapes and NUL
+ * bytes are errBadPath.
+ */
+func cleanPath(rawPath string) (string, error) {
+	decoded, err := url.PathUnescape(rawPath)
+	if err != nil || decoded == "" || strings.IndexByte(decoded, 0) >= 0 {
+		return "", errBadPath
+	}
+	decoded = strings.Replace(decoded, "\\", "/", -1)
+	cleaned := path.Clean("/" + decoded)
+	last := decoded[strings.LastIndex(decoded, "/")+1:]
+	if cleaned != "/" && (last == "" || last == "." || last == "..") {
+		cleaned += "/"
+	}
+	return cleaned, nil
+}
+
+/**
+ * The real path of the working dir (see realPath), resolved once by resolveRoot when the
+ * cache is built. Empty if the working dir is missing, the reads then fail on their own.
+ */
+var realRoot string
+
+func resolveRoot() {
+	realRoot, _ = realPath(rootDir())
+}
+
+func rootDir() string {
+	if workingDir == "" {
+		return "."
+	}
+	return workingDir
+}
+
+/**
+ * Follows the symlinks on the way to a (cleaned) filename and makes sure it ends up
+ * inside the working dir, errOutsideRoot otherwise. Files that don't exist are checked
+ * up to their closest existing parent, so a missing file behind an escaping symlink is
+ * refused as well. This is disk I/O, so it only runs on a miss (see cache.Options.CheckFile).
+ */
+func checkInsideRoot(filename string) error {
+	if realRoot == "" {
+		return nil
+	}
+	real, err := realPath(filepath.Join(rootDir(), filepath.FromSlash(filename)))
+	if err != nil {
+		return errOutsideRoot
+	}
+	rel, err := filepath.Rel(realRoot, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return errOutsideRoot
+	}
+	return nil
+}
+
+/**
+ * Absolute path with every symlink resolved. Missing trailing parts of the path are
+ * kept as they are (the path must already be clean).
+ */
+func realPath(p string) (string, error) {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	missing := ""
+	for {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(real, missing), nil
+		}
+		parent := filepath.Dir(p)
+		if !(os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR)) || parent == p {
+			return "", err
+		}
+		if _, lerr := os.Lstat(p); lerr == nil {
+			return "", err // A dangling symlink, we can't tell where it would point.
+		}
+		missing = filepath.Join(filepath.Base(p), missing)
+		p = parent
+	}
+}
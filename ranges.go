@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server/cache"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/**
+ * A single byte range of a file (start is inclusive, length is in bytes).
+ */
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.start+br.length-1, size)
+}
+
+var (
+	errInvalidRange       = errors.New("invalid range")
+	errUnsatisfiableRange = errors.New("unsatisfiable range")
+)
+
+/**
+ * Parses a Range header (RFC 7233) for a file of the given size. Ranges that start past
+ * the end of the file are dropped and the error is errUnsatisfiableRange if none are left.
+ * Malformed headers (or ranges that ask for more than the file) are errInvalidRange,
+ * in which case the header should be ignored and the whole file sent.
+ */
+func parseRange(header string, size int64) ([]byteRange, error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil, errInvalidRange
+	}
+	var ranges []byteRange
+	var total int64
+	for _, spec := range strings.Split(header[len("bytes="):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		dash := strings.Index(spec, "-")
+		if dash < 0 {
+			return nil, errInvalidRange
+		}
+		first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+		var br byteRange
+		if first == "" {
+			// Suffix range, the last N bytes of the file.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n > size {
+				n = size
+			}
+			if n == 0 {
+				continue
+			}
+			br = byteRange{size - n, n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+					return nil, errInvalidRange
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue // Not satisfiable, but the other ranges might be.
+			}
+			br = byteRange{start, end - start + 1}
+		}
+		total += br.length
+		ranges = append(ranges, br)
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	if total > size {
+		return nil, errInvalidRange // Overlapping ranges, cheaper to just send the file.
+	}
+	return ranges, nil
+}
+
+/**
+ * Checks the If-Range header. A range request with an If-Range that doesn't match the
+ * current validators must get the whole file.
+ */
+func ifRangeMatches(r *http.Request, validators cache.Validators) bool {
+	ifRange := r.Header.Get("If-Range")
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, "\"") {
+		return validators.ETag != "" && ifRange == validators.ETag // Strong comparison.
+	}
+	ifRangeTime, err := http.ParseTime(ifRange)
+	return err == nil && !validators.ModTime.IsZero() && validators.ModTime.Unix() == ifRangeTime.Unix()
+}
+
+/**
+ * Writes a 206 response with the given parts (one per range), as multipart/byteranges
+ * when there is more than one.
+ */
+func writeRanges(w http.ResponseWriter, filename string, ranges []byteRange, parts [][]byte, size int64) {
+	contentType := userlib.GetContentType(filename)
+	if len(ranges) == 1 {
+		w.Header().Set(userlib.ContextType, contentType)
+		w.Header().Set("Content-Range", ranges[0].contentRange(size))
+		w.Header().Set("Content-Length", strconv.Itoa(len(parts[0])))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write(parts[0])
+		return
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, br := range ranges {
+		part, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {contentType},
+			"Content-Range": {br.contentRange(size)},
+		})
+		_, _ = part.Write(parts[i])
+	}
+	_ = mw.Close()
+	w.Header().Set(userlib.ContextType, "multipart/byteranges; boundary="+mw.Boundary())
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.WriteHeader(http.StatusPartialContent)
+	_, _ = w.Write(body.Bytes())
+}
+
+/**
+ * Answers a range request from file data that is already in memory (i.e. a cache hit).
+ * Returns false if the request should get the whole file instead.
+ */
+func serveRanges(w http.ResponseWriter, r *http.Request, file *cache.File) bool {
+	header := r.Header.Get("Range")
+	if header == "" || !ifRangeMatches(r, file.Validators) {
+		return false
+	}
+	data := file.Data
+	size := int64(len(data))
+	ranges, err := parseRange(header, size)
+	if err == errUnsatisfiableRange {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return true
+	} else if err != nil {
+		return false
+	}
+	parts := make([][]byte, len(ranges))
+	for i, br := range ranges {
+		parts[i] = data[br.start : br.start+br.length]
+	}
+	sendFileData(file, func([]byte) error {
+		if copyBeforeWrite(r, file) {
+			for i := range parts {
+				parts[i] = append([]byte(nil), parts[i]...)
+			}
+		}
+		writeRanges(w, file.Name, ranges, parts, size)
+		return nil
+	})
+	return true
+}
+
+/**
+ * Answers a range request that missed the cache by reading only the requested bytes
+ * off the disk. Returns false if it can't, in which case the request should go through
+ * the cache like any other (this includes requests that need the file's ETag).
+ */
+func servePartialFile(w http.ResponseWriter, r *http.Request, filename string) bool {
+	if r.Header.Get("If-Range") != "" || r.Header.Get("If-None-Match") != "" || checkInsideRoot(filename) != nil {
+		return false
+	}
+	file, err := os.Open(filepath.Join(workingDir, filename))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() || isStreamed(info.Size()) {
+		return false // Streamed files are left to streamFile, which doesn't buffer the ranges.
+	}
+	ranges, err := parseRange(r.Header.Get("Range"), info.Size())
+	if err != nil {
+		return false
+	}
+	validators := cache.Validators{ModTime: info.ModTime()}
+	if isNotModified(r, validators) {
+		setValidatorHeaders(w, validators)
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	parts := make([][]byte, len(ranges))
+	for i, br := range ranges {
+		parts[i] = make([]byte, br.length)
+		if _, err := io.ReadFull(io.NewSectionReader(file, br.start, br.length), parts[i]); err != nil {
+			return false
+		}
+	}
+	setValidatorHeaders(w, validators)
+	w.Header().Set("Accept-Ranges", "bytes")
+	writeRanges(w, filename, ranges, parts, info.Size())
+	return true
+}
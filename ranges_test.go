@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func validatePartialResponse(resp *ResponseWriterTester, contentRange string, expected []byte, t *testing.T) (failed bool) {
+	if resp.statusCode != http.StatusPartialContent {
+		failed = true
+		t.Errorf("Received the wrong status code! Expected: (%v), Actual: (%v)", http.StatusPartialContent, resp.statusCode)
+	}
+	if resp.header.Get("Content-Range") != contentRange {
+		failed = true
+		t.Errorf("Received the wrong Content-Range! Expected: (%s), Actual: (%s)", contentRange, resp.header.Get("Content-Range"))
+	}
+	if !bytes.Equal(resp.data, expected) {
+		failed = true
+		t.Errorf("The data that was received was not what was expected! Expected (%s), Actual (%s)", string(expected), string(resp.data))
+	}
+	return failed
+}
+
+// ============ Range Request Tests ============
+
+func TestRangeParse(t *testing.T) {
+	tests := []struct {
+		header   string
+		size     int64
+		expected []byteRange
+		err      error
+	}{
+		{"bytes=0-4", 10, []byteRange{{0, 5}}, nil},
+		{"bytes=5-", 10, []byteRange{{5, 5}}, nil},
+		{"bytes=-3", 10, []byteRange{{7, 3}}, nil},
+		{"bytes=-30", 10, []byteRange{{0, 10}}, nil},
+		{"bytes=8-20", 10, []byteRange{{8, 2}}, nil},
+		{"bytes=0-1, 4-5", 10, []byteRange{{0, 2}, {4, 2}}, nil},
+		{"bytes=0-1,20-30", 10, []byteRange{{0, 2}}, nil},
+		{"bytes=10-", 10, nil, errUnsatisfiableRange},
+		{"bytes=-0", 10, nil, errUnsatisfiableRange},
+		{"bytes=0-0", 0, nil, errUnsatisfiableRange},
+		{"bytes=5-4", 10, nil, errInvalidRange},
+		{"bytes=a-b", 10, nil, errInvalidRange},
+		{"bytes=5", 10, nil, errInvalidRange},
+		{"items=0-4", 10, nil, errInvalidRange},
+		{"bytes=0-9,0-9", 10, nil, errInvalidRange},
+	}
+	for _, test := range tests {
+		ranges, err := parseRange(test.header, test.size)
+		if err != test.err {
+			t.Errorf("Wrong error for (%s)! Expected: (%v), Actual: (%v)", test.header, test.err, err)
+		}
+		if !reflect.DeepEqual(ranges, test.expected) {
+			t.Errorf("Wrong ranges for (%s)! Expected: (%v), Actual: (%v)", test.header, test.expected, ranges)
+		}
+	}
+}
+
+func TestRangeFromCache(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	name := "/resume.pdf"
+	dataToBeRead := []byte("0123456789abcdefghij")
+	var reads uint64 = 0
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		atomic.AddUint64(&reads, 1)
+		data = dataToBeRead
+		return
+	})
+	resp := requestFile(name, secTimeout, t)
+	validateFileResponse("."+name, "."+name, dataToBeRead, resp, userlib.SUCCESSCODE, t)
+	if resp.header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("The response should advertise byte ranges! Actual: (%s)", resp.header.Get("Accept-Ranges"))
+	}
+	// Single range.
+	resp = genResponseTestWriter()
+	handler(resp, genConditionalRequest(name, "Range", "bytes=2-5"))
+	validatePartialResponse(resp, "bytes 2-5/20", []byte("2345"), t)
+	// Multiple ranges.
+	resp = genResponseTestWriter()
+	handler(resp, genConditionalRequest(name, "Range", "bytes=0-1,-3"))
+	if resp.statusCode != http.StatusPartialContent {
+		t.Errorf("Received the wrong status code! Expected: (%v), Actual: (%v)", http.StatusPartialContent, resp.statusCode)
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.header.Get(userlib.ContextType))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Expected a multipart/byteranges response, got: (%s)", resp.header.Get(userlib.ContextType))
+	}
+	reader := multipart.NewReader(bytes.NewReader(resp.data), params["boundary"])
+	expectedParts := []struct{ contentRange, data string }{{"bytes 0-1/20", "01"}, {"bytes 17-19/20", "hij"}}
+	for _, expected := range expectedParts {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("Could not read the next part: %v", err)
+		}
+		data, _ := ioutil.ReadAll(part)
+		if part.Header.Get("Content-Range") != expected.contentRange || string(data) != expected.data {
+			t.Errorf("Wrong part! Expected: (%s: %s), Actual: (%s: %s)", expected.contentRange, expected.data, part.Header.Get("Content-Range"), string(data))
+		}
+	}
+	// Unsatisfiable range.
+	resp = genResponseTestWriter()
+	handler(resp, genConditionalRequest(name, "Range", "bytes=20-"))
+	if resp.statusCode != http.StatusRequestedRangeNotSatisfiable || resp.header.Get("Content-Range") != "bytes */20" {
+		t.Errorf("Expected a 416 with (bytes */20), Actual: (%v) with (%s)", resp.statusCode, resp.header.Get("Content-Range"))
+	}
+	// Stale If-Range gets the whole file.
+	req := genConditionalRequest(name, "Range", "bytes=2-5")
+	req.Header.Set("If-Range", "\"61c\"")
+	resp = genResponseTestWriter()
+	handler(resp, req)
+	validateFileResponse("."+name, "."+name, dataToBeRead, resp, userlib.SUCCESSCODE, t)
+	// Matching If-Range gets the range.
+	req.Header.Set("If-Range", resp.header.Get("ETag"))
+	resp = genResponseTestWriter()
+	handler(resp, req)
+	validatePartialResponse(resp, "bytes 2-5/20", []byte("2345"), t)
+	validateNumberOfReads(1, reads, t)
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestRangePartialReadOnMiss(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	dir, err := ioutil.TempDir("", "ranges")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	workingDir = dir // No trailing slash, the partial read must join it like the cache does.
+	launchCache()
+	name := "/movie.jpg"
+	dataToBeRead := []byte("0123456789abcdefghij")
+	if err := ioutil.WriteFile(filepath.Join(dir, name), dataToBeRead, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var reads uint64 = 0
+	gate := make(chan bool)
+	// We set the userlib FileRead function to read from the temp dir, once the gate opens.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		<-gate
+		atomic.AddUint64(&reads, 1)
+		return ioutil.ReadFile(filepath.Join(workingDir, filename))
+	})
+	// The partial read doesn't wait for the read function.
+	resp := genResponseTestWriter()
+	handler(resp, genConditionalRequest(name, "Range", "bytes=10-14"))
+	validatePartialResponse(resp, "bytes 10-14/20", []byte("abcde"), t)
+	close(gate)
+	// The whole file gets cached in the background.
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	validateCacheSize(1, len(dataToBeRead), t)
+	validateNumberOfReads(1, reads, t)
+	resp = genResponseTestWriter()
+	handler(resp, genConditionalRequest(name, "Range", "bytes=-2"))
+	validatePartialResponse(resp, "bytes 18-19/20", []byte("ij"), t)
+	validateNumberOfReads(1, reads, t)
+	workingDir = ""
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+// ============ End of Range Request Tests ============
@@ -0,0 +1,85 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// ============ Canceled Read Tests ============
+
+func TestTimeoutCancelsRead(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = t.TempDir()
+	cancelReads = true // The server's own reads, not the userlib fake.
+	defer func() {
+		workingDir = ""
+		cancelReads = false
+		launchCache()
+	}()
+	launchCache()
+	// A fifo never ends, so reading it only stops once the read is canceled. The writer
+	// then finds the pipe closed.
+	fifo := filepath.Join(workingDir, "endless.txt")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		writer, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		if err != nil {
+			stopped <- err
+			return
+		}
+		defer writer.Close()
+		chunk := make([]byte, 4096)
+		for {
+			if _, err := writer.Write(chunk); err != nil {
+				stopped <- err
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	// The request times out long before the cache does.
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	resp := genResponseTestWriter()
+	handler(resp, genRequestUrl("/endless.txt").WithContext(ctx))
+	if resp.statusCode != userlib.TIMEOUTERRORCODE {
+		t.Errorf("Received the wrong status code! Expected: (%v), Actual: (%v)", userlib.TIMEOUTERRORCODE, resp.statusCode)
+	}
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, syscall.EPIPE) {
+			t.Errorf("The read stopped for the wrong reason: %v", err)
+		}
+	case <-time.After(time.Duration(secTimeout) * time.Second):
+		t.Errorf("The read was not canceled when its request timed out!")
+	}
+	validateCacheSize(0, 0, t)
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+// ============ End of Canceled Read Tests ============
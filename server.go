@@ -1,22 +1,37 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server/cache"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 /**
- * Debugging utility to toggle logging.
+ * Debugging utility to toggle logging. It can be toggled at runtime (see setLogging).
  */
-var isLogging bool
+var isLogging int32
+
+func setLogging(on bool) {
+	var value int32
+	if on {
+		value = 1
+	}
+	atomic.StoreInt32(&isLogging, value)
+}
 
 func debugLog(msg string) {
-	if isLogging {
+	if atomic.LoadInt32(&isLogging) == 1 {
 		log.Println(msg)
 	}
 }
@@ -25,10 +40,17 @@ func debugLog(msg string) {
  * Globals Variables for server.
  */
 var (
-	port       int
-	capacity   int
-	timeout    int
-	workingDir string
+	port           int
+	capacity       int
+	timeout        int
+	timeoutMs      int
+	workingDir     string
+	evictionPolicy = "random"
+	watchFiles     bool
+	mmapSize       int64 // Cached files of at least this many bytes are memory-mapped (0 to never).
+
+	diskCacheDir      string // Second cache tier on the local disk (off if empty).
+	diskCacheCapacity int64  = 1 << 30
 )
 
 /**
@@ -37,35 +59,154 @@ var (
 func handler(w http.ResponseWriter, r *http.Request) {
 	debugLog(fmt.Sprintf(">> Requesting (raw): '%v'", r.URL.Path))
 	startTime := time.Now()
+	recorder := recordResponse(w)
+	w = recorder
+	defer func() {
+		observeRequest(recorder.statusCode(), time.Now().Sub(startTime))
+	}()
+	filename, err := resolveFilename(r.URL.EscapedPath())
+	if err != nil {
+		debugLog(fmt.Sprintf("<< [ERROR] Refused: '%v' | MSG: %v", r.URL.Path, err))
+		http.Error(w, err.Error(), pathErrorCode(err))
+		return
+	}
 
-	response := getFile(r.URL.Path)
-	if response.responseError != nil {
-		errStr := response.responseError.Error()
+	w.Header().Set("Vary", "Accept-Encoding")
+	recorder.filename = filename // Its header rules only go on a success.
+	var file *cache.File
+	if r.Header.Get("Range") == "" {
+		file, err = fetchEncodedFile(r.Context(), r, filename)
+	} else {
+		file = fileCache.GetCached(filename)
+		if file == nil && servePartialFile(w, r, filename) {
+			recorder.cache = "MISS"
+			debugLog(fmt.Sprintf("<< Returned (partial read): '%v' | It took: %v",
+				filename, time.Now().Sub(startTime).String()))
+			go warmFile(filename) // Warm the cache for the next request.
+			return
+		}
+	}
+	if file == nil && err == nil {
+		file, err = fetchFile(r.Context(), filename)
+	}
+	defer file.Release() // A mapped file must stay mapped until it is sent.
+	if err == cache.ErrTooLarge && streamFile(w, r, filename) {
+		recorder.cache = "STREAM"
+		debugLog(fmt.Sprintf("<< Streamed: '%v' | It took: %v", filename, time.Now().Sub(startTime).String()))
+		return
+	}
+	if file != nil && file.Stale {
+		recorder.cache = "STALE"
+	} else if file != nil && file.Hit {
+		recorder.cache = "HIT"
+	} else {
+		recorder.cache = "MISS"
+	}
+	if err == context.Canceled {
+		debugLog(fmt.Sprintf("<< [ERROR] Abandoned: '%v' | It took: %v",
+			filename, time.Now().Sub(startTime).String()))
+		w.WriteHeader(statusClientClosedRequest) // Nobody is listening, this is for the logs.
+		return
+	}
+	if err != nil {
 		debugLog(fmt.Sprintf("<< [ERROR] Returned: '%v' | It took: %v | MSG: %v",
-			response.filename, time.Now().Sub(startTime).String(),
-			strings.Replace(errStr, "\n", "\\n", -1)))
-		if errStr == userlib.TimeoutString {
-			http.Error(w, errStr, userlib.TIMEOUTERRORCODE)
+			filename, time.Now().Sub(startTime).String(), err))
+		if err == cache.ErrTimeout || err == context.DeadlineExceeded {
+			http.Error(w, userlib.TimeoutString, userlib.TIMEOUTERRORCODE)
+		} else if err == errOutsideRoot {
+			http.Error(w, err.Error(), pathErrorCode(err))
 		} else {
-			http.Error(w, errStr, userlib.FILEERRORCODE)
+			http.Error(w, userlib.FILEERRORMSG, userlib.FILEERRORCODE)
 		}
 		return
 	}
+	setValidatorHeaders(w, file.Validators)
+	if isNotModified(r, file.Validators) {
+		debugLog(fmt.Sprintf("<< Not modified: '%v' | It took: %v",
+			file.Name, time.Now().Sub(startTime).String()))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 	debugLog(fmt.Sprintf("<< Returned: '%v' | It took: %v",
-		response.filename, time.Now().Sub(startTime).String()))
+		file.Name, time.Now().Sub(startTime).String()))
 
-	w.Header().Set(userlib.ContextType, userlib.GetContentType(response.filename))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if serveRanges(w, r, file) {
+		return
+	}
+	if file.Variant != "" {
+		w.Header().Set("Content-Encoding", file.Variant)
+	}
+	w.Header().Set(userlib.ContextType, userlib.GetContentType(file.Name))
+	w.Header().Set("Content-Length", strconv.Itoa(len(file.Data)))
 	w.WriteHeader(userlib.SUCCESSCODE)
-	_, _ = w.Write(*response.responseData)
+	if !isHead(r) {
+		sendFileData(file, func(data []byte) error {
+			if copyBeforeWrite(r, file) {
+				return writeCopies(w, data)
+			}
+			_, err := w.Write(data)
+			return err
+		})
+	}
+}
+
+/**
+ * Hands the data of a file to send (see cache.File.ReadData). If the file is mapped and
+ * was truncated on disk in the middle, it is too late for an error: the response is cut
+ * off and the file dropped from the cache.
+ */
+func sendFileData(file *cache.File, send func(data []byte) error) {
+	if err := file.ReadData(send); err == cache.ErrFileChanged {
+		debugLog(fmt.Sprintf("<< [ERROR] Cut off: '%v' | MSG: %v", file.Name, err))
+		fileCache.Invalidate(file.Name)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+/**
+ * Whether the data of a file must be copied before it is written. HTTP/2 writes it from
+ * another goroutine (its frame writer), where the fault of reading a mapped file that was
+ * truncated on disk is not caught (see sendFileData) and would crash the server.
+ */
+func copyBeforeWrite(r *http.Request, file *cache.File) bool {
+	return r.ProtoMajor == 2 && file.Mapped()
+}
+
+/**
+ * Size of the copies made by writeCopies.
+ */
+const copyChunkSize = 64 * 1024
+
+/**
+ * Writes data through a buffer, one chunk at a time (see copyBeforeWrite). The buffer can
+ * be reused since a write is done with the data once it returns.
+ */
+func writeCopies(w io.Writer, data []byte) error {
+	chunk := make([]byte, copyChunkSize)
+	for len(data) > 0 {
+		n := copy(chunk, data)
+		if _, err := w.Write(chunk[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
 }
 
+/**
+ * Status code (borrowed from nginx) for requests whose client went away before the response.
+ */
+const statusClientClosedRequest = 499
+
 /**
  * The handler for cache status.
  */
 func cacheHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set(userlib.ContextType, userlib.GetContentType("AriaKillsTheNightKing.txt"))
 	w.WriteHeader(userlib.SUCCESSCODE)
-	_, _ = w.Write([]byte(getCacheStatus()))
+	stats := fileCache.StatsTop(0)
+	_, _ = w.Write([]byte(fmt.Sprintf(userlib.CapacityString, stats.Items, stats.BytesUsed, stats.Capacity)))
 }
 
 /**
@@ -74,252 +215,278 @@ func cacheHandler(w http.ResponseWriter, r *http.Request) {
 func cacheClearHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set(userlib.ContextType, userlib.GetContentType("IronManDies.txt"))
 	w.WriteHeader(userlib.SUCCESSCODE)
-	_, _ = w.Write([]byte(cacheClear()))
+	fileCache.Clear()
+	_, _ = w.Write([]byte(userlib.CacheCloseMessage))
 }
 
 /**
- * Internal structure and channel for file communication between threads.
+ * The handlers for requests to evict a single file (/cache/evict/<path>) or every
+ * file under a path prefix (/cache/evict-prefix/<prefix>) from the cache. Prefixes
+ * match whole path segments only.
  */
-type fileResponse struct {
-	filename      string
-	responseData  *[]byte
-	responseError error
-	responseChan  chan *fileResponse
+type evictReport struct {
+	Removed    []string `json:"removed"`
+	BytesFreed int      `json:"bytes_freed"`
 }
 
-type fileRequest struct {
-	filename string
-	response chan *fileResponse
+func cacheEvictHandler(w http.ResponseWriter, r *http.Request) {
+	filename, err := resolveFilename(strings.TrimPrefix(r.URL.EscapedPath(), "/cache/evict"))
+	if err != nil {
+		http.Error(w, err.Error(), pathErrorCode(err))
+		return
+	}
+	writeEvictReport(w, fileCache.Evict(filename))
+}
+
+func cacheEvictPrefixHandler(w http.ResponseWriter, r *http.Request) {
+	cleaned, err := cleanPath(strings.TrimPrefix(r.URL.EscapedPath(), "/cache/evict-prefix"))
+	if err != nil {
+		http.Error(w, err.Error(), pathErrorCode(err))
+		return
+	}
+	prefix := "./" + cleaned[1:]
+	if strings.HasSuffix(prefix, "/") {
+		writeEvictReport(w, fileCache.EvictPrefix(prefix))
+		return
+	}
+	// Only whole path segments match: the file itself and whatever is under it, so
+	// '/res' doesn't evict './resume/...'. Both come sorted and the file sorts first.
+	writeEvictReport(w, append(fileCache.Evict(prefix), fileCache.EvictPrefix(prefix+"/")...))
 }
 
-var fileChan = make(chan *fileRequest)
+func writeEvictReport(w http.ResponseWriter, removed []*cache.File) {
+	writeJSON(w, newEvictReport(removed))
+	cache.ReleaseFiles(removed)
+}
 
-/**
- * Wrapper function sanitizes the filepath/filename and gets the file from cache.
- */
-func getFile(filename string) (response *fileResponse) {
-	for strings.Contains(filename, "/../") ||
-		strings.Contains(filename, "\\/") ||
-		strings.Contains(filename, "//") {
-		filename = strings.Replace(filename, "/../", "/", -1)
-		filename = strings.Replace(filename, "\\/", "/", -1)
-		filename = strings.Replace(filename, "//", "/", -1)
-	}
-	if filename[len(filename)-1] == '/' {
-		filename += "index.html"
-	}
-	request := fileRequest{"./" + filename[1:], make(chan *fileResponse)}
-	fileChan <- &request
-	return <-request.response
+func newEvictReport(removed []*cache.File) evictReport {
+	report := evictReport{[]string{}, 0}
+	for _, file := range removed { // Sorted by name, so a file's variants come right after it.
+		if n := len(report.Removed); n == 0 || report.Removed[n-1] != file.Name {
+			report.Removed = append(report.Removed, file.Name)
+		}
+		report.BytesFreed += len(file.Data)
+	}
+	return report
 }
 
 /**
- * Internal variables, structures and channels for the cache.
+ * The handler for requests to change the cache capacity (/cache/resize?bytes=N) without
+ * clearing it. Shrinking evicts files (with the eviction policy) until the cache fits,
+ * those are reported like the evictions above, next to the new capacity.
  */
-var (
-	cacheCapacityChan = make(chan chan string)
-	cacheCloseChan    = make(chan bool)
-	cacheOpChan       = make(chan *cacheOp)
-	WRITE             = 0
-	READ              = 1
-	STATS             = 2
-)
-
-type cacheEntry struct {
-	filename string
-	data     *[]byte
-	valid    bool
-	size     int
-	count    int
+type resizeReport struct {
+	Capacity int `json:"capacity"`
+	evictReport
 }
 
-type cache struct {
-	table map[string]*cacheEntry
-	size  int // Size of ALL data (values) in bytes
+func cacheResizeHandler(w http.ResponseWriter, r *http.Request) {
+	bytes, err := strconv.Atoi(r.URL.Query().Get("bytes"))
+	if err != nil || bytes < 0 {
+		http.Error(w, "bytes must be a non-negative number", http.StatusBadRequest)
+		return
+	}
+	removed := fileCache.Resize(bytes)
+	debugLog(fmt.Sprintf("<< Resized the cache to %v bytes, evicted %v files", bytes, len(removed)))
+	writeJSON(w, resizeReport{bytes, newEvictReport(removed)})
+	cache.ReleaseFiles(removed)
 }
 
-type cacheOp struct {
-	op       int // 0 = Write, 1 = Read, 2 = Stats
-	filename string
-	data     *[]byte
-	readChan chan *cacheEntry
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(userlib.ContextType, "application/json")
+	w.WriteHeader(userlib.SUCCESSCODE)
+	_, _ = w.Write(body)
 }
 
 /**
- * This function requests and returns the cache status.
+ * The file cache, built from the flags by newFileCache.
  */
-func getCacheStatus() (response string) {
-	responseChan := make(chan string)
-	cacheCapacityChan <- responseChan
-	return <-responseChan
-}
+var fileCache *cache.Cache
 
 /**
- * This function toggles a cache clear and returns a message when cleared.
- * NOTE: Concurrent cache clears are NOT supported.
+ * Whether the cache reads files on a miss with cache.ReadFile instead of userlib.ReadFile.
+ * Its reads of abandoned misses (e.g. every request waiting on it went away or timed out)
+ * are canceled through their context, but userlib.ReplaceReadFile doesn't apply to them.
  */
-func cacheClear() (response string) {
-	cacheCloseChan <- true
-	<-cacheCloseChan // Wait until the cache is closed before restarting
-	go operateCache()
-	return userlib.CacheCloseMessage
+var cancelReads bool
+
+func missReadFunc() cache.ReadFunc {
+	if cancelReads {
+		return cache.ReadFile
+	}
+	return cache.IgnoreContext(func(dir, name string) ([]byte, error) {
+		return userlib.ReadFile(dir, name) // Looked up on every read, see userlib.ReplaceReadFile.
+	})
+}
+
+func newFileCache() (*cache.Cache, error) {
+	resolveRoot()
+	return cache.New(cache.Options{
+		Capacity:    capacity,
+		Timeout:     cacheTimeout(),
+		Dir:         workingDir,
+		Eviction:    evictionPolicy,
+		ReadFile:    missReadFunc(),
+		ReadVariant: readEncodedFile,
+		CheckFile:   checkInsideRoot,
+		OnRead:      diskReadLatency.observe,
+		Debug:       debugLog,
+
+		TTL:                  fileTTL,
+		StaleWhileRevalidate: staleWhileRevalidate,
+		StaleIfError:         staleIfError,
+		MaxFileSize:          streamThreshold,
+		LimitToCapacity:      streamThreshold > 0,
+		MmapSize:             mmapSize,
+		DiskDir:              diskCacheDir,
+		DiskCapacity:         diskCacheCapacity,
+	})
 }
 
 /**
- * This thread is spawned once from the main cache thread (operateCache) during its initialization.
- * It handles all map operations for the cache, thus avoiding any data races.
+ * The timeout for cache misses, -t-ms wins over -t when it is set.
  */
-func cacheMapOperator(close chan bool) {
-	cache := cache{make(map[string]*cacheEntry), 0}
-	for {
-		//Debugging
-		//keys := make([]string, 0, len(cache.table))
-		//for k := range cache.table {
-		//	keys = append(keys, k)
-		//}
-		//fmt.Printf("Len (%v): %v\n", len(keys), keys)
-
-		select { // Drain the close channel first.
-		case <-close:
-			return
-		default:
-		}
-
-		select {
-		case <-close:
-			return
-		case cacheOp := <-cacheOpChan:
-			switch cacheOp.op {
-			case WRITE:
-				if len(*cacheOp.data) > capacity {
-					continue // Don't destroy cache if cache can't fit data.
-				}
-				debugLog(fmt.Sprintf("\t\t\tAdding %v to cache", cacheOp.filename))
-				if entry, ok := cache.table[cacheOp.filename]; ok {
-					delete(cache.table, cacheOp.filename)
-					cache.size -= len(*entry.data)
-				}
-				for k := range cache.table {
-					if cache.size+len(*cacheOp.data) <= capacity {
-						break
-					}
-					delEntry := cache.table[k]
-					delete(cache.table, delEntry.filename)
-					cache.size -= len(*delEntry.data)
-				}
-				cache.table[cacheOp.filename] = &cacheEntry{cacheOp.filename,
-					cacheOp.data, true, -1, -1}
-				cache.size += len(*cacheOp.data)
-			case READ:
-				entry, ok := cache.table[cacheOp.filename]
-				if !ok {
-					entry = &cacheEntry{"", nil, false, -1, -1}
-				}
-				cacheOp.readChan <- entry
-			case STATS:
-				entry := &cacheEntry{"", nil, false,
-					cache.size, len(cache.table)}
-				cacheOp.readChan <- entry
-			}
-		}
+func cacheTimeout() time.Duration {
+	if timeoutMs > 0 {
+		return time.Millisecond * time.Duration(timeoutMs)
 	}
+	return time.Second * time.Duration(timeout)
 }
 
 /**
- * This thread is spawned from the main cache thread (operateCache) every time the
- * cache misses. This enables concurrent file reads. Also, this thread returns a
- * request to the request's channel once it reads AND caches data (or when timeout occurs).
- * NOTE: Thread stays active until the read data is cached (even when timing out).
+ * Wrapper function resolves the filepath/filename and gets the file from cache.
  */
-func cacheMiss(fileReq *fileRequest) {
-	processedChan := make(chan bool, 1)
+func getFile(ctx context.Context, filename string) (*cache.File, error) {
+	resolved, err := resolveFilename(filename)
+	if err != nil {
+		return nil, err
+	}
+	return fetchFile(ctx, resolved)
+}
 
-	go func() {
-		data, err := userlib.ReadFile(workingDir, fileReq.filename)
-		if err != nil {
-			// Don't cache if it's a file error.
-			fileReq.response <- &fileResponse{fileReq.filename, &data,
-				fmt.Errorf(userlib.FILEERRORMSG), fileReq.response}
-		} else {
-			cacheOpChan <- &cacheOp{WRITE, fileReq.filename, &data, nil}
-			fileReq.response <- &fileResponse{fileReq.filename, &data,
-				nil, fileReq.response}
-		}
-		processedChan <- true
-	}()
+/**
+ * Gets an (already resolved) file from the cache. The request stops waiting once ctx is done.
+ */
+func fetchFile(ctx context.Context, filename string) (*cache.File, error) {
+	return fileCache.Get(ctx, filename)
+}
 
-	select {
-	case <-processedChan:
-	case <-time.After(time.Second * time.Duration(timeout)):
-		debugLog(fmt.Sprintf("\t\t[!!] Time out: %v", fileReq.filename))
-		fileReq.response <- &fileResponse{fileReq.filename, nil,
-			fmt.Errorf(userlib.TimeoutString), fileReq.response}
-		<-processedChan // Don't close thread until read file is cached.
-	}
+/**
+ * Reads a file into the cache without anybody waiting for it.
+ */
+func warmFile(filename string) {
+	file, _ := fetchFile(context.Background(), filename)
+	file.Release()
 }
 
 /**
- * This thread handles all cache file requests at runtime and spawns off
- * all of the necessary threads at runtime.
+ * Routes the requests to the handlers. Files and cache information can be read with
+ * GET (or HEAD), while changing the cache takes a POST (or DELETE). The file and the
+ * admin routes (cache information and changes) can be served by different muxes, the
+ * admin routes are always behind the admin access control.
  */
-func operateCache() {
-	mapOpCloseChan := make(chan bool)
-	go cacheMapOperator(mapOpCloseChan)
-
-	for {
-		select {
-		case fileReq := <-fileChan:
-			cacheOp := cacheOp{READ, fileReq.filename,
-				nil, make(chan *cacheEntry)}
-			cacheOpChan <- &cacheOp
-			cacheEntry := <-cacheOp.readChan
-			if cacheEntry.valid {
-				debugLog(fmt.Sprintf("\t[*]Hit: %v", fileReq.filename))
-				fileReq.response <- &fileResponse{cacheEntry.filename, cacheEntry.data,
-					nil, fileReq.response}
-			} else {
-				debugLog(fmt.Sprintf("\t[!]Miss: %v", fileReq.filename))
-				go cacheMiss(fileReq)
-			}
-		case cacheReq := <-cacheCapacityChan:
-			cacheOp := cacheOp{STATS, "", nil, make(chan *cacheEntry)}
-			cacheOpChan <- &cacheOp
-			entry := <-cacheOp.readChan
-			cacheReq <- fmt.Sprintf(userlib.CapacityString, entry.count, entry.size, capacity)
-		case cacheClose := <-cacheCloseChan:
-			if cacheClose {
-				mapOpCloseChan <- true
-				for {
-					select {
-					case <-cacheOpChan: // Flush any remaining cache operations.
-					default:
-						cacheCloseChan <- false
-						return
-					}
-				}
-			}
-		}
+func newServeMux(files, admin bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	if files {
+		mux.HandleFunc("/", allowMethods(handler, readMethods...))
+		mux.HandleFunc("/ready", allowMethods(readyHandler, readMethods...)) // For load balancers, no credentials.
+	}
+	if admin {
+		mux.HandleFunc("/cache/", withAdminAuth(allowMethods(cacheHandler, readMethods...)))
+		mux.HandleFunc("/metrics", withAdminAuth(allowMethods(metricsHandler, readMethods...)))
+		mux.HandleFunc("/cache/stats.json", withAdminAuth(allowMethods(cacheStatsHandler, readMethods...)))
+		mux.HandleFunc("/cache/clear/", withAdminAuth(allowMethods(cacheClearHandler, adminMethods...)))
+		mux.HandleFunc("/cache/evict/", withAdminAuth(allowMethods(cacheEvictHandler, adminMethods...)))
+		mux.HandleFunc("/cache/evict-prefix/", withAdminAuth(allowMethods(cacheEvictPrefixHandler, adminMethods...)))
+		mux.HandleFunc("/cache/resize", withAdminAuth(allowMethods(cacheResizeHandler, http.MethodPost)))
 	}
+	return mux
 }
 
 func main() {
-	flag.IntVar(&port, "p", 8080, "Port to listen for HTTP requests (default port 8080).")
-	flag.IntVar(&capacity, "c", 1000000, "Number of bytes to allow in the cache.")
-	flag.IntVar(&timeout, "t", 2, "Default timeout (in seconds) to wait before returning an error.")
-	flag.StringVar(&workingDir, "d", "public_html/", "The directory which the files are hosted in.")
-	flag.BoolVar(&isLogging, "l", false, "Log debugging messages.")
+	flagValues := &config{}
+	registerFlags(flag.CommandLine, flagValues)
 	flag.Parse()
 
-	fmt.Printf("Server starting, port: %v, cache size: %v, timout: %v, working dir: '%s'\n",
-		port, capacity, timeout, workingDir)
+	var err error
+	settings := flagValues
+	var reloader *configReloader
+	if configPath != "" {
+		explicit := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+		if settings, err = loadConfig(configPath, flagValues, explicit); err != nil {
+			log.Fatal(err)
+		}
+		reloader = &configReloader{filename: configPath, flagValues: flagValues, explicit: explicit, active: settings}
+	} else if err = settings.validate(); err != nil {
+		log.Fatal(err)
+	}
+	settings.apply()
+
+	var certs *certReloader
+	if tlsCertFile != "" || tlsKeyFile != "" {
+		if certs, err = newCertReloader(tlsCertFile, tlsKeyFile); err != nil {
+			log.Fatal(err)
+		}
+		certs.watch(certPollInterval)
+	}
+	if adminAuth, err = newAdminAccess(adminTokenFile, adminPasswordFile, adminAllowList); err != nil {
+		log.Fatal(err)
+	}
+	if fileCache, err = newFileCache(); err != nil {
+		log.Fatal(err)
+	}
+	if reloader != nil {
+		reloader.reloadOnHangup() // Once there is a cache to resize.
+	}
+	if warmSource != "" {
+		names, err := warmList(warmSource)
+		if err != nil {
+			log.Fatal(err)
+		}
+		warmup = startWarmup(names)
+	}
+
+	fmt.Printf("Server starting, port: %v, cache size: %v, timout: %v, working dir: '%s', eviction: %v\n",
+		port, capacity, cacheTimeout(), workingDir, evictionPolicy)
 	serverString := fmt.Sprintf(":%v", port)
 
-	http.HandleFunc("/", handler)
-	http.HandleFunc("/cache/", cacheHandler)
-	http.HandleFunc("/cache/clear/", cacheClearHandler)
+	var closers []io.Closer // Closed once the connections are drained.
+	if watchFiles {
+		fileWatcher, err := startWatcher(workingDir, fileCache)
+		if err != nil {
+			log.Fatal(err)
+		}
+		closers = append(closers, fileWatcher)
+	}
 
-	go operateCache()
+	var rootHandler http.Handler = newServeMux(true, adminAddr == "")
+	var adminHandler http.Handler = newServeMux(false, true)
+	if accessLogPath != "" {
+		accessLog, err := newAccessLog(accessLogPath, accessLogFormat, accessLogMaxBytes, accessLogMaxAge)
+		if err != nil {
+			log.Fatal(err)
+		}
+		reopenOnHangup(accessLog)
+		closers = append(closers, accessLog)
+		rootHandler = withAccessLog(accessLog, rootHandler)
+		adminHandler = withAccessLog(accessLog, adminHandler)
+	}
 
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-	log.Fatal(http.ListenAndServe(serverString, nil))
+	servers := []*http.Server{newServer(serverString, rootHandler, certs)}
+	if adminAddr != "" {
+		fmt.Printf("Admin endpoints on: %v\n", adminAddr)
+		servers = append(servers, newServer(adminAddr, adminHandler, certs))
+	}
+	if certs != nil && tlsRedirectPort != 0 {
+		fmt.Printf("Redirecting HTTP to HTTPS from port: %v\n", tlsRedirectPort)
+		servers = append(servers, newServer(fmt.Sprintf(":%v", tlsRedirectPort), redirectToHTTPS(port), nil))
+	}
+	os.Exit(serveUntilSignal(servers, closers))
 }
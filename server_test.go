@@ -2,11 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server/cache"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
@@ -164,15 +171,17 @@ func requestFile(filename string, secTimeout int, t *testing.T) *ResponseWriterT
 	return resp
 }
 
-var launched = false
-
-//func init() {
-//	go operateCache()
-//}
+/*
+ *	Replaces the file cache with a new one built from the capacity, timeout, workingDir
+ *	and evictionPolicy globals.
+ */
 func launchCache() {
-	if launched == false {
-		launched = true
-		go operateCache()
+	if fileCache != nil {
+		fileCache.Close()
+	}
+	var err error
+	if fileCache, err = newFileCache(); err != nil {
+		panic(err)
 	}
 }
 
@@ -581,6 +590,208 @@ func TestImplIndexFileTests(t *testing.T) {
 	clearCache()
 }
 
+func validateEvictReport(resp *ResponseWriterTester, removed []string, bytesFreed int, t *testing.T) (failed bool) {
+	report := evictReport{}
+	if err := json.Unmarshal(resp.data, &report); err != nil {
+		t.Errorf("Could not parse the eviction report (%s): %v", string(resp.data), err)
+		return true
+	}
+	if !reflect.DeepEqual(report.Removed, removed) {
+		failed = true
+		t.Errorf("The wrong files were evicted! Expected: (%v), Actual: (%v)", removed, report.Removed)
+	}
+	if report.BytesFreed != bytesFreed {
+		failed = true
+		t.Errorf("The wrong number of bytes were freed! Expected: (%v), Actual: (%v)", bytesFreed, report.BytesFreed)
+	}
+	return failed
+}
+
+func TestImplEvictEndpoints(t *testing.T) {
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	var reads uint64 = 0
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		atomic.AddUint64(&reads, 1)
+		data = []byte(fmt.Sprintf("FID:%v", filename[2:]))
+		return
+	})
+	names := []string{"/index.html", "/resume/index.html", "/resume/css/style.css", "/resume/js/app.js", "/resumes.txt"}
+	size := 0
+	for _, name := range names {
+		requestFile(name, secTimeout, t)
+		size += len("FID:") + len(name) - 1
+	}
+	validateCacheSize(len(names), size, t)
+	// Evicting a file that isn't cached doesn't do anything.
+	resp := genResponseTestWriter()
+	cacheEvictHandler(resp, genRequestUrl("/cache/evict/missing.html"))
+	validateEvictReport(resp, []string{}, 0, t)
+	// The path goes through the same resolution as file requests.
+	resp = genResponseTestWriter()
+	cacheEvictHandler(resp, genRequestUrl("/cache/evict/..//resume/\\/css/style.css"))
+	validateEvictReport(resp, []string{"./resume/css/style.css"}, len("FID:resume/css/style.css"), t)
+	size -= len("FID:resume/css/style.css")
+	validateCacheSize(len(names)-1, size, t)
+	// Prefixes only match whole directories when they end with a slash.
+	resp = genResponseTestWriter()
+	cacheEvictPrefixHandler(resp, genRequestUrl("/cache/evict-prefix/resume/"))
+	validateEvictReport(resp, []string{"./resume/index.html", "./resume/js/app.js"},
+		len("FID:resume/index.html")+len("FID:resume/js/app.js"), t)
+	size -= len("FID:resume/index.html") + len("FID:resume/js/app.js")
+	validateCacheSize(2, size, t)
+	// The directory index is evicted like any other file.
+	resp = genResponseTestWriter()
+	cacheEvictHandler(resp, genRequestUrl("/cache/evict/"))
+	validateEvictReport(resp, []string{"./index.html"}, len("FID:index.html"), t)
+	validateCacheSize(1, len("FID:resumes.txt"), t)
+	// Evicted files are read again, the others are still cached.
+	for _, name := range names {
+		requestFile(name, secTimeout, t)
+	}
+	validateNumberOfReads(uint64(len(names)+4), reads, t)
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestImplEvictPrefixSegments(t *testing.T) {
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		data = []byte(fmt.Sprintf("FID:%v", filename[2:]))
+		return
+	})
+	names := []string{"/res", "/res/index.html", "/res/css/style.css", "/resume/index.html", "/resources.css"}
+	size := 0
+	for _, name := range names {
+		requestFile(name, secTimeout, t)
+		size += len("FID:") + len(name) - 1
+	}
+	validateCacheSize(len(names), size, t)
+	// A prefix only matches whole path segments, the sibling names that start the same stay.
+	resp := genResponseTestWriter()
+	cacheEvictPrefixHandler(resp, genRequestUrl("/cache/evict-prefix/res"))
+	validateEvictReport(resp, []string{"./res", "./res/css/style.css", "./res/index.html"},
+		len("FID:res")+len("FID:res/css/style.css")+len("FID:res/index.html"), t)
+	validateCacheSize(2, len("FID:resume/index.html")+len("FID:resources.css"), t)
+	// Neither does a partial file name.
+	resp = genResponseTestWriter()
+	cacheEvictPrefixHandler(resp, genRequestUrl("/cache/evict-prefix/resource"))
+	validateEvictReport(resp, []string{}, 0, t)
+	validateCacheSize(2, len("FID:resume/index.html")+len("FID:resources.css"), t)
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestImplResizeEndpoint(t *testing.T) {
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	evictionPolicy = "lru"
+	launchCache()
+	evictionPolicy = "random" // Only the cache we just launched should use it.
+	var reads uint64 = 0
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		atomic.AddUint64(&reads, 1)
+		data = []byte(fmt.Sprintf("FID:%v", filename[2:]))
+		return
+	})
+	resize := func(query string) (*ResponseWriterTester, *resizeReport) {
+		resp := genResponseTestWriter()
+		cacheResizeHandler(resp, genRequestRawUrl("/cache/resize"+query))
+		report := &resizeReport{}
+		if resp.statusCode == userlib.SUCCESSCODE {
+			if err := json.Unmarshal(resp.data, report); err != nil {
+				t.Errorf("Could not parse the resize report (%s): %v", string(resp.data), err)
+			}
+		}
+		return resp, report
+	}
+	for _, name := range []string{"/a.html", "/b.html", "/c.html", "/d.html"} {
+		requestFile(name, secTimeout, t)
+	}
+	requestFile("/a.html", secTimeout, t) // '/b.html' is now the least recently used.
+	validateCacheSize(4, 40, t)
+	for _, query := range []string{"", "?bytes=", "?bytes=-1", "?bytes=lots"} {
+		if resp, _ := resize(query); resp.statusCode != http.StatusBadRequest {
+			t.Errorf("A bad resize (%s) was accepted! Status: (%v)", query, resp.statusCode)
+		}
+	}
+	// Shrinking evicts with the eviction policy until the cache fits, the rest stays.
+	resp, report := resize("?bytes=25")
+	validateEvictReport(resp, []string{"./b.html", "./c.html"}, 20, t)
+	if report.Capacity != 25 {
+		t.Errorf("Wrong capacity in the report! Expected: (25), Actual: (%v)", report.Capacity)
+	}
+	if stats := fileCache.Stats(); stats.Capacity != 25 || stats.Items != 2 || stats.BytesUsed != 20 {
+		t.Errorf("Wrong cache after a resize! Expected: (capacity 25, 2 items, 20 bytes), Actual: (%v, %v, %v)",
+			stats.Capacity, stats.Items, stats.BytesUsed)
+	}
+	requestFile("/a.html", secTimeout, t)
+	requestFile("/d.html", secTimeout, t)
+	validateNumberOfReads(4, reads, t)
+	// Growing doesn't evict anything, and the new room gets used.
+	resp, report = resize("?bytes=1000")
+	validateEvictReport(resp, []string{}, 0, t)
+	for _, name := range []string{"/b.html", "/c.html"} {
+		requestFile(name, secTimeout, t)
+	}
+	validateCacheSize(4, 40, t)
+	validateNumberOfReads(6, reads, t)
+	// It goes through the admin routes, for POST only.
+	for _, method := range []string{http.MethodGet, http.MethodDelete, http.MethodPost} {
+		resp = genResponseTestWriter()
+		req := genRequestRawUrl("/cache/resize?bytes=0")
+		req.Method = method
+		newServeMux(true, true).ServeHTTP(resp, req)
+		if method != http.MethodPost {
+			validateNotAllowed(resp, "POST", t)
+		} else if resp.statusCode != userlib.SUCCESSCODE {
+			t.Errorf("Could not POST a resize! Status: (%v)", resp.statusCode)
+		}
+	}
+	if stats := fileCache.Stats(); stats.Capacity != 0 || stats.Items != 0 {
+		t.Errorf("Resizing to 0 should have emptied the cache! Actual: (capacity %v, %v items)", stats.Capacity, stats.Items)
+	}
+	launchCache()
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
 // ============ End of Implementation Tests ============
 
 // ============ File String Sanitization Tests ============
@@ -701,12 +912,12 @@ func TestSanitizationPreviousDirectory(t *testing.T) {
 	resp = genResponseTestWriter()
 	name = "/file/../Ptest.61c"
 	req = genRequestUrl(name)
-	expected = "./file/Ptest.61c"
+	expected = "./Ptest.61c"
 	handler(resp, req)
 	resp = genResponseTestWriter()
 	name = "/../file/../tool/Ptest.61c"
 	req = genRequestUrl(name)
-	expected = "./file/tool/Ptest.61c"
+	expected = "./tool/Ptest.61c"
 	handler(resp, req)
 	resp = genResponseTestWriter()
 	if capacity != secCap {
@@ -747,17 +958,17 @@ func TestSanitizationSimpleCombinations(t *testing.T) {
 	resp = genResponseTestWriter()
 	name = "//file/../SCtest.61c"
 	req = genRequestUrl(name)
-	expected = "./file/SCtest.61c"
+	expected = "./SCtest.61c"
 	handler(resp, req)
 	resp = genResponseTestWriter()
 	name = "/../file\\//../tool/SCtest.61c"
 	req = genRequestUrl(name)
-	expected = "./file/tool/SCtest.61c"
+	expected = "./tool/SCtest.61c"
 	handler(resp, req)
 	resp = genResponseTestWriter()
 	name = "/..//..///../file/..//..//..///../\\//..//..//../exams//\\/SCtest.61c"
 	req = genRequestUrl(name)
-	expected = "./file/exams/SCtest.61c"
+	expected = "./exams/SCtest.61c"
 	handler(resp, req)
 	if capacity != secCap {
 		t.Errorf("The max capacity has been changed when it should not have been!")
@@ -893,17 +1104,17 @@ func TestSanitizationComplexCombinations(t *testing.T) {
 	resp = genResponseTestWriter()
 	name = "//file/..//cCtest.61c"
 	req = genRequestUrl(name)
-	expected = "./file/cCtest.61c"
+	expected = "./cCtest.61c"
 	handler(resp, req)
 	resp = genResponseTestWriter()
 	name = "\\/../file\\/../tool/cCtest.61c"
 	req = genRequestUrl(name)
-	expected = "./file/tool/cCtest.61c"
+	expected = "./tool/cCtest.61c"
 	handler(resp, req)
 	resp = genResponseTestWriter()
 	name = "/../..//../file/..\\\\\\\\//../..//\\//../\\/../../..\\//..\\//..\\//..\\//..\\//..\\/exams//\\/cCtest.61c"
 	req = genRequestUrl(name)
-	expected = "./file/exams/cCtest.61c"
+	expected = "./exams/cCtest.61c"
 	handler(resp, req)
 	if capacity != secCap {
 		t.Errorf("The max capacity has been changed when it should not have been!")
@@ -916,6 +1127,172 @@ func TestSanitizationComplexCombinations(t *testing.T) {
 	clearCache()
 }
 
+func TestSanitizationResolveTable(t *testing.T) {
+	workingDir = ""
+	tests := []struct {
+		raw      string
+		expected string
+		err      error
+	}{
+		{"/", "./index.html", nil},
+		{"/test.61c", "./test.61c", nil},
+		{"test.61c", "./test.61c", nil},
+		{"/dir/", "./dir/index.html", nil},
+		{"/dir/.", "./dir/index.html", nil},
+		{"/dir/sub/..", "./dir/index.html", nil},
+		{"/dir/..", "./index.html", nil},
+		{"/..", "./index.html", nil},
+		{"/../../../etc/passwd", "./etc/passwd", nil},
+		{"/a/./b/../c.61c", "./a/c.61c", nil},
+		{"/%2e%2e/%2E%2E/secret.61c", "./secret.61c", nil},
+		{"/a/%2e%2e%2fb.61c", "./b.61c", nil},
+		{"/a%5c..%5cb.61c", "./b.61c", nil},
+		{"\\..\\..\\b.61c", "./b.61c", nil},
+		{"/with%20space.61c", "./with space.61c", nil},
+		{"/100%25.61c", "./100%.61c", nil},
+		{"", "", errBadPath},
+		{"/bad%zzescape", "", errBadPath},
+		{"/trailing%", "", errBadPath},
+		{"/nul%00byte", "", errBadPath},
+	}
+	for _, test := range tests {
+		filename, err := resolveFilename(test.raw)
+		if filename != test.expected || err != test.err {
+			t.Errorf("Wrong resolution of (%q)! Expected: (%q, %v), Actual: (%q, %v)",
+				test.raw, test.expected, test.err, filename, err)
+		}
+	}
+}
+
+func TestSanitizationBadRequests(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		t.Errorf("No file should have been read! Read: (%s)", filename)
+		return
+	})
+	// Bad escapes never get here, net/http refuses to parse them.
+	for _, name := range []string{"", "/nul\x00byte"} {
+		resp := genResponseTestWriter()
+		req := genRequestUrl(name)
+		handler(resp, req)
+		if resp.statusCode != http.StatusBadRequest {
+			t.Errorf("Received the wrong status code for (%q)! Expected: (%v), Actual: (%v)", name, http.StatusBadRequest, resp.statusCode)
+		}
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestSanitizationSymlinkEscape(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	root := t.TempDir()
+	outside := t.TempDir()
+	for file, data := range map[string]string{
+		root + "/public/in/file.61c": "inside", root + "/private.61c": "secret",
+		outside + "/secret.61c": "secret"} {
+		_ = os.MkdirAll(filepath.Dir(file), 0755)
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		root + "/public/out":        outside,
+		root + "/public/secret.61c": outside + "/secret.61c",
+		root + "/public/up":         root,
+		root + "/public/alias":      root + "/public/in",
+		root + "/public/dangling":   outside + "/missing.61c",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("Symlinks are not supported here: %v", err)
+		}
+	}
+	workingDir = root + "/public/"
+	launchCache()
+	// We set the userlib FileRead function to read from the disk.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		return ioutil.ReadFile(workingDir + filename)
+	})
+	tests := map[string]int{
+		"/in/file.61c":           userlib.SUCCESSCODE,
+		"/alias/file.61c":        userlib.SUCCESSCODE, // Links inside the root are fine.
+		"/in/missing.61c":        userlib.FILEERRORCODE,
+		"/out/secret.61c":        http.StatusForbidden,
+		"/out/missing.61c":       http.StatusForbidden, // Don't tell what exists out there.
+		"/secret.61c":            http.StatusForbidden,
+		"/up/public/in/file.61c": userlib.SUCCESSCODE, // Back inside the root.
+		"/up/private.61c":        http.StatusForbidden,
+		"/dangling":              http.StatusForbidden,
+		"/in/file.61c/sub.61c":   userlib.FILEERRORCODE,
+	}
+	for name, code := range tests {
+		resp := requestFile(name, secTimeout, t)
+		if resp.statusCode != code {
+			t.Errorf("Received the wrong status code for (%s)! Expected: (%v), Actual: (%v)", name, code, resp.statusCode)
+		}
+		if code == http.StatusForbidden && bytes.Contains(resp.data, []byte("secret")) {
+			t.Errorf("Served a file from outside of the root for (%s)!", name)
+		}
+	}
+	workingDir = ""
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func FuzzSanitizationResolve(f *testing.F) {
+	workingDir = ""
+	for _, seed := range []string{"/", "/test.61c", "/../a/./b//c", "\\/..\\/x", "/%2e%2e/%2fy", "/a/..", "", "%"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, raw string) {
+		filename, err := resolveFilename(raw)
+		if err != nil {
+			if err != errBadPath && err != errOutsideRoot {
+				t.Errorf("Unexpected error for (%q): %v", raw, err)
+			}
+			return
+		}
+		if !strings.HasPrefix(filename, "./") || path.Clean(filename[1:]) != filename[1:] ||
+			strings.Contains(filename, "\\") || strings.HasSuffix(filename, "/") {
+			t.Errorf("Resolved (%q) to a path that is not clean: (%q)", raw, filename)
+		}
+		for _, segment := range strings.Split(filename[2:], "/") {
+			if segment == ".." || segment == "." || segment == "" {
+				t.Errorf("Resolved (%q) to a path with a (%q) segment: (%q)", raw, segment, filename)
+			}
+		}
+		// Resolving is idempotent.
+		if again, err := resolveFilename((&url.URL{Path: filename[1:]}).EscapedPath()); err != nil || again != filename {
+			t.Errorf("Resolving (%q) again gave (%q, %v)", filename, again, err)
+		}
+	})
+}
+
 // ============ End of File String Sanitization Tests ============
 
 // ============ Timeout Tests ============
@@ -1121,6 +1498,82 @@ func TestTimeoutNoResponseThenSecondHasResponse(t *testing.T) {
 	clearCache()
 }
 
+func TestTimeoutMilliseconds(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	msTimeout := 200
+	capacity = secCap
+	timeoutMs = msTimeout
+	workingDir = ""
+	launchCache()
+	timeoutMs = 0 // Only the cache we just launched should use it.
+	slowname := "/slowfile.61c"
+	slowdata := []byte("I am some slow data!")
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		time.Sleep(time.Duration(msTimeout*2) * time.Millisecond)
+		data = slowdata
+		return
+	})
+	start := time.Now()
+	resp := requestFile(slowname, 1, t)
+	if took := time.Now().Sub(start); took > time.Duration(msTimeout*2)*time.Millisecond {
+		t.Errorf("The timeout should have been %vms! It took: %v", msTimeout, took)
+	}
+	validateTimeout(resp, t)
+	// A late read still fills the cache.
+	time.Sleep(time.Duration(msTimeout*2) * time.Millisecond)
+	validateCacheSize(1, len(slowdata), t)
+	launchCache()
+}
+
+func TestTimeoutClientGone(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	slowname := "/slowfile.61c"
+	canceled := make(chan bool, 1)
+	// The request's context is handed to the cache, so the read sees the client going away.
+	fileCache.Close()
+	var err error
+	if fileCache, err = cache.New(cache.Options{Capacity: secCap, Timeout: cacheTimeout(),
+		ReadFile: func(ctx context.Context, workingDir, filename string) ([]byte, error) {
+			<-ctx.Done()
+			canceled <- true
+			return nil, ctx.Err()
+		}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	resp := genResponseTestWriter()
+	req := genRequestUrl(slowname).WithContext(ctx)
+	done := make(chan bool)
+	go func() {
+		handler(resp, req)
+		done <- true
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Duration(secTimeout) * time.Second / 2):
+		t.Fatalf("The handler kept waiting after the client went away!")
+	}
+	if resp.statusCode != statusClientClosedRequest {
+		t.Errorf("Received the wrong status code! Expected: (%v), Actual: (%v)", statusClientClosedRequest, resp.statusCode)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Duration(secTimeout) * time.Second):
+		t.Errorf("The read was not canceled when nobody waited on it anymore!")
+	}
+	validateCacheSize(0, 0, t)
+	launchCache()
+}
+
 // ============ End of Timeout Tests ============
 
 // ============ Exact Capacity Tests ============
@@ -1993,6 +2446,100 @@ func TestMultithreadingTwoThreadsSameFile(t *testing.T) {
 	clearCache()
 }
 
+func TestMultithreadingNThreadsSameColdFileSingleRead(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	numThreads := 500
+	fileData := []byte("I am some spicy data for a lot of threads")
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	fileName := "/coldfile.61c"
+	var reads uint64 = 0
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		atomic.AddUint64(&reads, 1)
+		// Give every thread the time to ask for the file before the read finishes.
+		time.Sleep(time.Duration(500) * time.Millisecond)
+		data = fileData
+		return
+	})
+	done := make(chan bool)
+	for i := 0; i < numThreads; i++ {
+		go func() {
+			resp := requestFile(fileName, secTimeout, t)
+			validateFileResponse("", "", fileData, resp, userlib.SUCCESSCODE, t)
+			done <- true
+		}()
+	}
+	for i := numThreads; i > 0; i-- {
+		<-done
+	}
+	validateNumberOfReads(1, reads, t)
+	validateCacheSize(1, len(fileData), t)
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestMultithreadingNThreadsSameColdFileSharedTimeout(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	numThreads := 100
+	fileData := []byte("I am some slow data for a lot of threads")
+	secCap := 1000
+	secTimeout := 1
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	fileName := "/slowfile.61c"
+	var reads uint64 = 0
+	finished := make(chan bool, 1)
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		atomic.AddUint64(&reads, 1)
+		time.Sleep(time.Duration(secTimeout*2) * time.Second)
+		data = fileData
+		finished <- true
+		return
+	})
+	done := make(chan bool)
+	for i := 0; i < numThreads; i++ {
+		go func() {
+			resp := requestFile(fileName, secTimeout, t)
+			validateTimeout(resp, t)
+			done <- true
+		}()
+	}
+	for i := numThreads; i > 0; i-- {
+		<-done
+	}
+	<-finished
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	// The late read still makes it into the cache.
+	validateCacheSize(1, len(fileData), t)
+	resp := requestFile(fileName, secTimeout, t)
+	validateFileResponse("", "", fileData, resp, userlib.SUCCESSCODE, t)
+	validateNumberOfReads(1, reads, t)
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
 func TestMultithreadingNThreadWithMultipleRequestsSmall(t *testing.T) {
 	// We first need to define a capacity and timeout so our cache has some parameters.
 	fileData := []byte("I am some very spicy data")
@@ -2117,4 +2664,128 @@ func TestMultithreadingNThreadWithMultipleRequestsLarge(t *testing.T) {
 	clearCache()
 }
 
+func TestMultithreadingNThreadsWithConcurrentClears(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	fileData := []byte("I am some data that keeps getting cleared")
+	iterations := 20
+	numThreads := 200
+	numClearers := 20
+	secCap := (len(fileData)+4)*numThreads/2 + 10
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	fileBaseName := "/thread.61c_"
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		time.Sleep(time.Duration(5) * time.Millisecond)
+		data = []byte(string(fileData) + filename[len(fileBaseName):])
+		return
+	})
+	stop := make(chan bool)
+	cleared := make(chan int)
+	for i := 0; i < numClearers; i++ {
+		go func() {
+			clears := 0
+			for {
+				select {
+				case <-stop:
+					cleared <- clears
+					return
+				default:
+					clearCache()
+					clears++
+				}
+			}
+		}()
+	}
+	for j := 0; j < iterations; j++ {
+		done := make(chan bool)
+		for i := 0; i < numThreads; i++ {
+			go func(id int) {
+				// Thread i
+				fid := fmt.Sprintf("%v", (id+j)%numThreads)
+				resp := requestFile(fileBaseName+fid, secTimeout, t)
+				validateFileResponse("", "", []byte(string(fileData)+"_"+fid), resp, userlib.SUCCESSCODE, t)
+				validateCacheNotExceeded(t)
+				done <- true
+			}(i)
+		}
+		for i := numThreads; i > 0; i-- {
+			<-done
+		}
+	}
+	close(stop)
+	clears := 0
+	for i := numClearers; i > 0; i-- {
+		clears += <-cleared
+	}
+	if clears == 0 {
+		t.Errorf("The cache was never cleared while the threads were running!")
+	}
+	validateCacheNotExceeded(t)
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+	validateCacheSize(0, 0, t)
+}
+
+func TestMultithreadingNThreadsSameColdFileClearedMidRead(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	numThreads := 500
+	fileData := []byte("I am some spicy data that got cleared")
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	fileName := "/coldfile.61c"
+	var reads uint64 = 0
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		atomic.AddUint64(&reads, 1)
+		time.Sleep(time.Duration(500) * time.Millisecond)
+		data = fileData
+		return
+	})
+	done := make(chan bool)
+	for i := 0; i < numThreads; i++ {
+		go func() {
+			resp := requestFile(fileName, secTimeout, t)
+			validateFileResponse("", "", fileData, resp, userlib.SUCCESSCODE, t)
+			done <- true
+		}()
+	}
+	// Clear while the (single) read is in flight, the requests still get the file...
+	time.Sleep(time.Duration(250) * time.Millisecond)
+	clearCache()
+	for i := numThreads; i > 0; i-- {
+		<-done
+	}
+	validateNumberOfReads(1, reads, t)
+	// ...but the read predates the clear, so it must not end up in the cache.
+	validateCacheSize(0, 0, t)
+	resp := requestFile(fileName, secTimeout, t)
+	validateFileResponse("", "", fileData, resp, userlib.SUCCESSCODE, t)
+	validateNumberOfReads(2, reads, t)
+	validateCacheSize(1, len(fileData), t)
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
 // ============ End of Multithreading Tests ============
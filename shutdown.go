@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/**
+ * How long a shutdown waits for the open requests (and disk reads) to finish (see main).
+ */
+var drainTimeout = 30 * time.Second
+
+/**
+ * Exit statuses after a SIGINT or SIGTERM: everything finished in time, or the drain
+ * deadline passed and the leftover connections were cut off.
+ */
+const (
+	exitDrained = 0
+	exitForced  = 2
+)
+
+/**
+ * Runs the servers until the process gets a SIGINT or SIGTERM, then drains them (see
+ * drain) and returns the exit status. A server that fails to start stops the process.
+ */
+func serveUntilSignal(servers []*http.Server, closers []io.Closer) int {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	failed := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			if err := listenAndServe(server); err != http.ErrServerClosed {
+				failed <- err
+			}
+		}(server)
+	}
+	select {
+	case err := <-failed:
+		log.Fatal(err)
+	case sig := <-stop:
+		log.Printf("Got %v, draining connections (for up to %v)", sig, drainTimeout)
+	}
+	signal.Stop(stop) // A second signal kills the process right away.
+	return drain(servers, closers, drainTimeout)
+}
+
+/**
+ * Stops the servers from taking new connections and waits (for up to timeout) for the
+ * open requests to finish, then stops the file cache and waits for its disk reads.
+ * Connections still open at the deadline are closed. The closers (access log, watcher)
+ * are closed last. Returns exitDrained if everything finished in time, exitForced otherwise.
+ */
+func drain(servers []*http.Server, closers []io.Closer, timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	status := exitDrained
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				debugLog(fmt.Sprintf("Could not drain %v: %v", server.Addr, err))
+				_ = server.Close()
+				mutex.Lock()
+				status = exitForced
+				mutex.Unlock()
+			}
+		}(server)
+	}
+	wg.Wait()
+	if fileCache != nil {
+		if err := fileCache.Shutdown(ctx); err != nil {
+			debugLog(fmt.Sprintf("Disk reads still in flight after the drain: %v", err))
+			status = exitForced
+		}
+	}
+	for _, closer := range closers {
+		_ = closer.Close()
+	}
+	if status == exitDrained {
+		log.Println("Drained all connections, exiting")
+	} else {
+		log.Println("Drain deadline passed, closed the remaining connections")
+	}
+	return status
+}
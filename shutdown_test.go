@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server/cache"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+/*
+ *	Starts a server whose handler signals 'started' and then waits on 'release'
+ *	before answering. Returns the server and the URL of its listener.
+ */
+func startBlockingServer(started, release chan bool, t *testing.T) (*http.Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(listener.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		_, _ = w.Write([]byte("drained"))
+	}), nil)
+	go server.Serve(listener)
+	return server, fmt.Sprintf("http://%v/", listener.Addr())
+}
+
+type closeRecorder struct {
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+// ============ Shutdown Tests ============
+
+func TestShutdownDrains(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	started, release := make(chan bool), make(chan bool)
+	server, url := startBlockingServer(started, release, t)
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		body <- string(data)
+	}()
+	<-started
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		close(release)
+	}()
+	closer := &closeRecorder{}
+	if status := drain([]*http.Server{server}, []io.Closer{closer}, time.Second*5); status != exitDrained {
+		t.Errorf("Wrong exit status! Expected: (%v), Actual: (%v)", exitDrained, status)
+	}
+	if received := <-body; received != "drained" {
+		t.Errorf("The open request was cut off! Expected: (drained), Actual: (%s)", received)
+	}
+	if !closer.closed {
+		t.Errorf("The closers were not closed after the drain!")
+	}
+	if _, err := fileCache.Get(context.Background(), "./a.html"); err != cache.ErrClosed {
+		t.Errorf("The cache is still running after the drain! Actual: (%v)", err)
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Errorf("The server still takes connections after the drain!")
+	}
+	launchCache()
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestShutdownForced(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	started, release := make(chan bool), make(chan bool)
+	defer close(release)
+	server, url := startBlockingServer(started, release, t)
+	failed := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			_, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		failed <- err
+	}()
+	<-started
+	startTime := time.Now()
+	if status := drain([]*http.Server{server}, nil, time.Millisecond*100); status != exitForced {
+		t.Errorf("Wrong exit status! Expected: (%v), Actual: (%v)", exitForced, status)
+	}
+	if elapsed := time.Now().Sub(startTime); elapsed > time.Second {
+		t.Errorf("The drain did not stop at its deadline! It took: (%v)", elapsed)
+	}
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Errorf("The stuck request should have been cut off!")
+		}
+	case <-time.After(time.Second * 2):
+		t.Errorf("The stuck connection was not closed after the deadline!")
+	}
+	launchCache()
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+// ============ End of Shutdown Tests ============
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server/cache"
+	"net/http"
+	"strconv"
+)
+
+/**
+ * The handler for cache statistics (as JSON, see cache.Stats), along with the progress of
+ * the warm-up (if any). The number of top keys can be set with ?top=N.
+ */
+type statsReport struct {
+	*cache.Stats
+	Warmup *warmStatus `json:"warmup,omitempty"`
+}
+
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	topN := cache.DefaultTopKeys
+	if top := r.URL.Query().Get("top"); top != "" {
+		n, err := strconv.Atoi(top)
+		if err != nil || n < 0 {
+			http.Error(w, "top must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		topN = n
+	}
+	report := statsReport{fileCache.StatsTop(topN), nil}
+	if warmup != nil {
+		status := warmup.snapshot()
+		report.Warmup = &status
+	}
+	writeJSON(w, report)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server/cache"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/*
+ *	Unlike genRequestUrl, this keeps the query string.
+ */
+func genRequestRawUrl(rawUrl string) *http.Request {
+	parsed, _ := url.Parse(rawUrl)
+	return &http.Request{URL: parsed}
+}
+
+func requestCacheStats(rawUrl string, t *testing.T) *cache.Stats {
+	resp := genResponseTestWriter()
+	cacheStatsHandler(resp, genRequestRawUrl(rawUrl))
+	stats := &cache.Stats{}
+	if err := json.Unmarshal(resp.data, stats); err != nil {
+		t.Fatalf("Could not parse the cache stats (%s): %v", string(resp.data), err)
+	}
+	return stats
+}
+
+func validateCounter(name string, before, after, expected uint64, t *testing.T) (failed bool) {
+	if after-before != expected {
+		failed = true
+		t.Errorf("The %s counter is wrong! Expected it to go up by (%v), Actual: (%v)", name, expected, after-before)
+	}
+	return failed
+}
+
+// ============ Cache Stats Tests ============
+
+func TestStatsCounters(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 20
+	secTimeout := 1
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		switch filename {
+		case "./missing.html":
+			err = fmt.Errorf("the file does not exist")
+		case "./slow.html":
+			time.Sleep(time.Duration(secTimeout*2) * time.Second)
+		default:
+			data = []byte(fmt.Sprintf("FID:%v", filename[2:]))
+		}
+		return
+	})
+	before := requestCacheStats("/cache/stats.json", t)
+	// 3 misses (5 bytes each), then hits: a twice, c once.
+	for _, name := range []string{"/a", "/b", "/c", "/a", "/c", "/a"} {
+		requestFile(name, secTimeout, t)
+	}
+	// 1 file error and 1 timeout, both count as misses.
+	validateBadFile("/missing.html", secTimeout, t)
+	validateTimeout(requestFile("/slow.html", secTimeout, t), t)
+	after := requestCacheStats("/cache/stats.json?top=2", t)
+	validateCounter("hits", before.Hits, after.Hits, 3, t)
+	validateCounter("misses", before.Misses, after.Misses, 5, t)
+	validateCounter("file errors", before.FileErrors, after.FileErrors, 1, t)
+	validateCounter("timeouts", before.Timeouts, after.Timeouts, 1, t)
+	validateCounter("evictions", before.Evictions, after.Evictions, 0, t)
+	if after.Items != 3 || after.BytesUsed != 15 || after.Capacity != secCap {
+		t.Errorf("Wrong cache usage! Expected: (3 items, 15/%v bytes), Actual: (%v items, %v/%v bytes)", secCap, after.Items, after.BytesUsed, after.Capacity)
+	}
+	expectedTop := []cache.KeyHits{{Key: "./a", Hits: 2}, {Key: "./c", Hits: 1}}
+	if !reflect.DeepEqual(after.TopKeys, expectedTop) {
+		t.Errorf("Wrong top keys! Expected: (%v), Actual: (%v)", expectedTop, after.TopKeys)
+	}
+	// Only 4 files fit, so the fifth one evicts one of them.
+	requestFile("/d", secTimeout, t)
+	requestFile("/e", secTimeout, t)
+	evicted := requestCacheStats("/cache/stats.json?top=0", t)
+	validateCounter("evictions", after.Evictions, evicted.Evictions, 1, t)
+	if len(evicted.TopKeys) != 0 {
+		t.Errorf("Asked for no top keys but got: (%v)", evicted.TopKeys)
+	}
+	resp := genResponseTestWriter()
+	cacheStatsHandler(resp, genRequestRawUrl("/cache/stats.json?top=lots"))
+	if resp.statusCode != 400 {
+		t.Errorf("Received the wrong status code! Expected: (%v), Actual: (%v)", 400, resp.statusCode)
+	}
+	time.Sleep(time.Duration(secTimeout) * time.Second) // Let the slow read finish before clearing.
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestStatsInFlightMisses(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	release := make(chan bool)
+	// We set the userlib FileRead function to block until the test is done looking.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		<-release
+		data = []byte("done")
+		return
+	})
+	done := make(chan bool)
+	for _, name := range []string{"/one", "/two", "/two"} {
+		go func(name string) {
+			requestFile(name, secTimeout, t)
+			done <- true
+		}(name)
+	}
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	if stats := requestCacheStats("/cache/stats.json", t); stats.InFlightMisses != 2 {
+		t.Errorf("Wrong number of in-flight misses! Expected: (2), Actual: (%v)", stats.InFlightMisses)
+	}
+	release <- true
+	release <- true
+	for i := 0; i < 3; i++ {
+		<-done
+	}
+	if stats := requestCacheStats("/cache/stats.json", t); stats.InFlightMisses != 0 {
+		t.Errorf("Wrong number of in-flight misses! Expected: (0), Actual: (%v)", stats.InFlightMisses)
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+// ============ End of Cache Stats Tests ============
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+/**
+ * Files bigger than this many bytes, or than the cache capacity, are streamed off the
+ * disk instead of going through the cache (0 turns streaming off), see streamFile.
+ */
+var streamThreshold int64
+
+/**
+ * Whether a file of the given size is streamed (same check as the cache, see
+ * cache.Options.MaxFileSize).
+ */
+func isStreamed(size int64) bool {
+	return streamThreshold > 0 && (size > streamThreshold || size > int64(fileCache.Capacity()))
+}
+
+/**
+ * Answers a request for a file that is too large for the cache (see cache.ErrTooLarge)
+ * straight from the disk, so a request only holds a small copy buffer (or nothing at all
+ * when the connection can sendfile). Conditional and range requests are answered by
+ * http.ServeContent, off the file's mod time. Returns false if the file can't be opened.
+ */
+func streamFile(w http.ResponseWriter, r *http.Request, filename string) bool {
+	file, err := os.Open(filepath.Join(workingDir, filename))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	w.Header().Set(userlib.ContextType, userlib.GetContentType(filename))
+	http.ServeContent(w, r, filename, info.ModTime(), file)
+	return true
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+/*
+ *	Writes a file of the given size to dir and returns its content.
+ */
+func writeLargeFile(dir, name string, size int, t testing.TB) []byte {
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+	if err := ioutil.WriteFile(dir+name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+/*
+ *	Response writer that throws the body away, so a benchmark only measures the server.
+ */
+type discardResponseWriter struct {
+	header     http.Header
+	statusCode int
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(d []byte) (int, error) {
+	return len(d), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+}
+
+// ============ Stream Tests ============
+
+func TestStreamLargeFiles(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = t.TempDir() + "/"
+	streamThreshold = 500
+	defer func() {
+		workingDir = ""
+		streamThreshold = 0
+		launchCache()
+	}()
+	launchCache()
+	reads := uint64(0)
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		atomic.AddUint64(&reads, 1)
+		return ioutil.ReadFile(workingDir + filename)
+	})
+	big := writeLargeFile(workingDir, "big.txt", 5000, t)
+	medium := writeLargeFile(workingDir, "medium.txt", 600, t)
+	small := writeLargeFile(workingDir, "small.txt", 100, t)
+
+	// Bigger than the capacity, or than the threshold: streamed and never read into memory.
+	for name, data := range map[string][]byte{"/big.txt": big, "/medium.txt": medium} {
+		resp := requestFile(name, secTimeout, t)
+		if validateFileResponse("", "", data, resp, userlib.SUCCESSCODE, t) {
+			t.Errorf("Could not stream (%s)!", name)
+		}
+		if resp.header.Get("Content-Length") != fmt.Sprint(len(data)) || resp.header.Get("Last-Modified") == "" {
+			t.Errorf("Wrong headers for a streamed file! Actual: (%v)", resp.header)
+		}
+	}
+	// Range requests are streamed too.
+	req := genRequestUrl("/big.txt")
+	req.Header = http.Header{"Range": {"bytes=4000-4009"}}
+	resp := genResponseTestWriter()
+	handler(resp, req)
+	if resp.statusCode != http.StatusPartialContent || !bytes.Equal(resp.data, big[4000:4010]) {
+		t.Errorf("Wrong range of a streamed file! Actual: (%v, %s)", resp.statusCode, resp.data)
+	}
+	// Small files still go through the cache.
+	requestFile("/small.txt", secTimeout, t)
+	if resp := requestFile("/small.txt", secTimeout, t); !bytes.Equal(resp.data, small) {
+		t.Errorf("Got the wrong small file!")
+	}
+	if reads != 1 {
+		t.Errorf("Only the small file should have been read (once)! Actual reads: (%v)", reads)
+	}
+	if stats := fileCache.Stats(); stats.Items != 1 || stats.TooLarge != 3 {
+		t.Errorf("Wrong stats! Expected: (1 item, 3 too large), Actual: (%v, %v)", stats.Items, stats.TooLarge)
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestStreamOnlyWithThreshold(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = t.TempDir() // No trailing slash, like -d public_html.
+	defer func() {
+		workingDir = ""
+		streamThreshold = 0
+		launchCache()
+	}()
+	launchCache()
+	reads := uint64(0)
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		atomic.AddUint64(&reads, 1)
+		return ioutil.ReadFile(filepath.Join(workingDir, filename))
+	})
+	big := writeLargeFile(workingDir+"/", "big.txt", 5000, t)
+
+	// Without -stream, a file bigger than the cache is read through userlib, like before.
+	requestFile("/big.txt", secTimeout, t)
+	if stats := fileCache.Stats(); reads != 1 || stats.Items != 0 || stats.TooLarge != 0 {
+		t.Errorf("The file should have been read without -stream! Actual: (%v reads, %v items, %v too large)",
+			reads, stats.Items, stats.TooLarge)
+	}
+	// With it, the same file is streamed off the disk.
+	streamThreshold = 1 << 40
+	launchCache()
+	resp := requestFile("/big.txt", secTimeout, t)
+	if validateFileResponse("", "", big, resp, userlib.SUCCESSCODE, t) {
+		t.Errorf("Could not stream the file bigger than the cache!")
+	}
+	if stats := fileCache.Stats(); reads != 1 || stats.Items != 0 || stats.TooLarge != 1 {
+		t.Errorf("The file should have been streamed! Actual: (%v reads, %v items, %v too large)",
+			reads, stats.Items, stats.TooLarge)
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+// ============ End of Stream Tests ============
+
+/*
+ *	Serves a file of 'size' bytes 'b.N' times, with a cache that can't hold it. When
+ *	streamed, the memory per request (B/op) stays flat however large the file is.
+ */
+func benchmarkLargeFile(b *testing.B, size int, stream bool) {
+	capacity = size - 1
+	timeout = 10
+	workingDir = b.TempDir() + "/"
+	if stream {
+		streamThreshold = 1 << 40 // Only streams what doesn't fit in the cache.
+	}
+	defer func() {
+		workingDir = ""
+		streamThreshold = 0
+		launchCache()
+	}()
+	launchCache()
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		return ioutil.ReadFile(workingDir + filename)
+	})
+	writeLargeFile(workingDir, "large.txt", size, b)
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp := &discardResponseWriter{header: http.Header{}}
+		handler(resp, genRequestUrl("/large.txt"))
+		if resp.statusCode != userlib.SUCCESSCODE {
+			b.Fatalf("Could not serve the file! Status: (%v)", resp.statusCode)
+		}
+	}
+}
+
+func BenchmarkStreamLargeFile(b *testing.B) {
+	benchmarkLargeFile(b, 8<<20, true)
+}
+
+func BenchmarkBufferedLargeFile(b *testing.B) {
+	benchmarkLargeFile(b, 8<<20, false)
+}
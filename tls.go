@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/**
+ * TLS settings (see main). The server speaks plain HTTP when tlsCertFile is empty.
+ */
+var (
+	tlsCertFile      string
+	tlsKeyFile       string
+	tlsRedirectPort  int // Port for plain HTTP requests that get redirected to HTTPS (0 to turn it off).
+	certPollInterval = 5 * time.Second
+)
+
+/**
+ * A certificate (and its key) that can be reloaded from the disk while the server runs.
+ * The certificate is only picked at the handshake, so a reload never drops the open
+ * connections: they keep the certificate they started with.
+ */
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	stamp    string // Mod times and sizes of both files at the last load.
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS needs both a certificate and a key file")
+	}
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+/**
+ * Loads the certificate and key again. On an error the current certificate is kept.
+ */
+func (c *certReloader) Reload() error {
+	stamp := c.fileStamp() // Stat first, so a concurrent write shows up at the next check.
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load the TLS certificate: %v", err)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cert = &cert
+	c.stamp = stamp
+	return nil
+}
+
+/**
+ * Reloads the certificate if either file changed since the last load, returns whether it did.
+ */
+func (c *certReloader) reloadIfChanged() (bool, error) {
+	c.mutex.RLock()
+	stamp := c.stamp
+	c.mutex.RUnlock()
+	if c.fileStamp() == stamp {
+		return false, nil
+	}
+	if err := c.Reload(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *certReloader) fileStamp() string {
+	stamp := ""
+	for _, name := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(name); err == nil {
+			stamp += fmt.Sprintf("%v:%v;", info.ModTime().UnixNano(), info.Size())
+		} else {
+			stamp += "-;"
+		}
+	}
+	return stamp
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cert, nil
+}
+
+/**
+ * Reloads the certificate every time the process gets a SIGHUP, and whenever the
+ * files change (checked every interval).
+ */
+func (c *certReloader) watch(interval time.Duration) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-hangup:
+				if err := c.Reload(); err != nil {
+					log.Println(err)
+				} else {
+					debugLog("Reloaded the TLS certificate (SIGHUP)")
+				}
+			case <-ticker.C:
+				if reloaded, err := c.reloadIfChanged(); err != nil {
+					log.Println(err) // Possibly half written, the next check tries again.
+				} else if reloaded {
+					debugLog("Reloaded the TLS certificate (the files changed)")
+				}
+			}
+		}
+	}()
+}
+
+/**
+ * TLS settings for a server using the given certificate. HTTP/2 is negotiated
+ * through ALPN, with HTTP/1.1 as the fallback.
+ */
+func newTLSConfig(c *certReloader) *tls.Config {
+	return &tls.Config{
+		GetCertificate: c.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+/**
+ * Builds a server for the handler, over TLS with the given certificate (if any).
+ */
+func newServer(addr string, handler http.Handler, certs *certReloader) *http.Server {
+	server := &http.Server{Addr: addr, Handler: handler}
+	if certs != nil {
+		server.TLSConfig = newTLSConfig(certs)
+	}
+	return server
+}
+
+func listenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "") // The certificate comes from the TLS config.
+	}
+	return server.ListenAndServe()
+}
+
+/**
+ * Handler for the plain HTTP port, it sends every request to the same URL over HTTPS.
+ */
+func redirectToHTTPS(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]") // No port in it.
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]" // IPv6.
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		debugLog(fmt.Sprintf("<< Redirecting: '%v' to '%v'", r.URL.Path, target))
+		http.Redirect(w, r, target, http.StatusPermanentRedirect) // Keeps the method, unlike a 301.
+	})
+}
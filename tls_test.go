@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+ *	Writes a fresh self-signed certificate (for localhost and 127.0.0.1) and its key
+ *	to the given files. The serial number tells the certificates apart.
+ */
+func writeSelfSignedCert(certFile, keyFile string, serial int64, t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the change shows up even on file systems with coarse mod times.
+	modTime := time.Now().Add(time.Duration(serial) * time.Second)
+	_ = os.Chtimes(certFile, modTime, modTime)
+	_ = os.Chtimes(keyFile, modTime, modTime)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func servedSerial(c *certReloader, t *testing.T) int64 {
+	cert, err := c.GetCertificate(nil)
+	if err != nil || cert == nil {
+		t.Fatalf("No certificate to serve: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.Int64()
+}
+
+/*
+ *	An HTTP client that trusts the given (self-signed) certificates.
+ */
+func tlsClient(certs ...*x509.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool, ServerName: "localhost"},
+		ForceAttemptHTTP2: true,
+	}}
+}
+
+// ============ TLS Tests ============
+
+func TestTLSCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Errorf("Missing certificate files were accepted!")
+	}
+	if _, err := newCertReloader(certFile, ""); err == nil {
+		t.Errorf("A certificate without a key was accepted!")
+	}
+	writeSelfSignedCert(certFile, keyFile, 1, t)
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Could not load the certificate: %v", err)
+	}
+	if serial := servedSerial(certs, t); serial != 1 {
+		t.Errorf("Wrong certificate served! Expected serial: (1), Actual: (%v)", serial)
+	}
+	if reloaded, err := certs.reloadIfChanged(); reloaded || err != nil {
+		t.Errorf("The certificate was reloaded without a change! Actual: (%v, %v)", reloaded, err)
+	}
+	writeSelfSignedCert(certFile, keyFile, 2, t)
+	if reloaded, err := certs.reloadIfChanged(); !reloaded || err != nil {
+		t.Errorf("The changed certificate was not reloaded! Actual: (%v, %v)", reloaded, err)
+	}
+	if serial := servedSerial(certs, t); serial != 2 {
+		t.Errorf("Wrong certificate served! Expected serial: (2), Actual: (%v)", serial)
+	}
+	// A broken certificate (e.g. half written) keeps the current one around.
+	if err := ioutil.WriteFile(certFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := certs.reloadIfChanged(); err == nil {
+		t.Errorf("A broken certificate was loaded!")
+	}
+	if err := certs.Reload(); err == nil {
+		t.Errorf("A broken certificate was loaded!")
+	}
+	if serial := servedSerial(certs, t); serial != 2 {
+		t.Errorf("Wrong certificate served! Expected serial: (2), Actual: (%v)", serial)
+	}
+}
+
+func TestTLSServesHTTP2(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	launchCache()
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		if filename != "./a.html" {
+			return nil, os.ErrNotExist // No precompressed siblings.
+		}
+		data = []byte("FID:a.html")
+		return
+	})
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := writeSelfSignedCert(certFile, keyFile, 1, t)
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(listener.Addr().String(), newServeMux(true, false), certs)
+	go server.ServeTLS(listener, "", "")
+	defer server.Close()
+	url := fmt.Sprintf("https://%v/a.html", listener.Addr())
+
+	get := func(client *http.Client) *http.Response {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("Could not get the file over TLS: %v", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != userlib.SUCCESSCODE || string(body) != "FID:a.html" {
+			t.Errorf("Wrong response! Expected: (%v, FID:a.html), Actual: (%v, %s)", userlib.SUCCESSCODE, resp.StatusCode, body)
+		}
+		if resp.ProtoMajor != 2 {
+			t.Errorf("HTTP/2 was not negotiated! Actual: (%v)", resp.Proto)
+		}
+		return resp
+	}
+	client := tlsClient(first)
+	get(client)
+	// Swapping the certificate keeps the open connection (and its certificate) alive.
+	second := writeSelfSignedCert(certFile, keyFile, 2, t)
+	if err := certs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	resp := get(client)
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 1 {
+		t.Errorf("The open connection was dropped on reload! Expected serial: (1), Actual: (%v)", serial)
+	}
+	// New connections get the new certificate.
+	resp = get(tlsClient(second))
+	if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Errorf("The reloaded certificate was not served! Expected serial: (2), Actual: (%v)", serial)
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestTLSRedirect(t *testing.T) {
+	tests := []struct {
+		host, uri string
+		port      int
+		expected  string
+	}{
+		{"example.com:8080", "/a.html", 8443, "https://example.com:8443/a.html"},
+		{"example.com", "/dir/?x=1", 443, "https://example.com/dir/?x=1"},
+		{"[::1]:80", "/", 443, "https://[::1]/"},
+		{"[::1]", "/", 8443, "https://[::1]:8443/"},
+	}
+	for _, test := range tests {
+		resp := genResponseTestWriter()
+		req, err := http.NewRequest(http.MethodPost, "http://"+test.host+test.uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		redirectToHTTPS(test.port).ServeHTTP(resp, req)
+		if resp.statusCode != http.StatusPermanentRedirect || resp.header.Get("Location") != test.expected {
+			t.Errorf("Wrong redirect! Expected: (%v, %v), Actual: (%v, %v)", http.StatusPermanentRedirect, test.expected,
+				resp.statusCode, resp.header.Get("Location"))
+		}
+	}
+}
+
+// ============ End of TLS Tests ============
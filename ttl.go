@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/**
+ * How long expired files keep being served while they are revalidated, and how long
+ * past their TTL the last good copy is served when reading them fails (see cache.Options).
+ */
+var (
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+)
+
+/**
+ * A time to live for the files whose path matches a glob (see path.Match), or whose
+ * content type does (e.g. "image/*"), e.g. {"path": "/news/*", "ttl": "1m"}. When both
+ * are set, both have to match.
+ */
+type ttlRule struct {
+	Path        string         `json:"path" toml:"path" yaml:"path"`
+	ContentType string         `json:"content_type" toml:"content_type" yaml:"content_type"`
+	TTL         configDuration `json:"ttl" toml:"ttl" yaml:"ttl"`
+}
+
+/**
+ * The default TTL and the rules in use, swapped as a whole on a reload.
+ */
+type ttlSettings struct {
+	defaultTTL time.Duration
+	rules      []ttlRule
+}
+
+var fileTTLs atomic.Value // *ttlSettings
+
+func setTTLs(defaultTTL time.Duration, rules []ttlRule) {
+	fileTTLs.Store(&ttlSettings{defaultTTL, rules})
+}
+
+/**
+ * The time to live of a (resolved) filename in the cache: that of the first rule that
+ * matches it, the default TTL otherwise. 0 means it never expires.
+ */
+func fileTTL(filename string) time.Duration {
+	settings, _ := fileTTLs.Load().(*ttlSettings)
+	if settings == nil {
+		return 0
+	}
+	urlPath := "/" + strings.TrimPrefix(filename, "./")
+	contentType := strings.TrimSpace(strings.Split(userlib.GetContentType(filename), ";")[0])
+	for _, rule := range settings.rules {
+		if rule.Path != "" {
+			if matched, _ := path.Match(rule.Path, urlPath); !matched {
+				continue
+			}
+		}
+		if rule.ContentType != "" {
+			if matched, _ := path.Match(rule.ContentType, contentType); !matched {
+				continue
+			}
+		}
+		return time.Duration(rule.TTL)
+	}
+	return settings.defaultTTL
+}
+
+/**
+ * Checks the TTL rules, the errors name the rule by its config key.
+ */
+func validateTTLRules(rules []ttlRule) error {
+	for i, rule := range rules {
+		switch {
+		case rule.Path == "" && rule.ContentType == "":
+			return fmt.Errorf("ttl_rules[%v]: needs a path or a content_type", i)
+		case rule.TTL < 0:
+			return fmt.Errorf("ttl_rules[%v]: must not be negative (got %v)", i, time.Duration(rule.TTL))
+		}
+		if _, err := path.Match(rule.Path, ""); err != nil || (rule.Path != "" && !strings.HasPrefix(rule.Path, "/")) {
+			return fmt.Errorf("ttl_rules[%v]: bad path glob '%s' (expected e.g. \"/news/*\")", i, rule.Path)
+		}
+		if _, err := path.Match(rule.ContentType, ""); err != nil {
+			return fmt.Errorf("ttl_rules[%v]: bad content type glob '%s' (expected e.g. \"image/*\")", i, rule.ContentType)
+		}
+	}
+	return nil
+}
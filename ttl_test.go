@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"os"
+	"testing"
+	"time"
+)
+
+// ============ TTL Tests ============
+
+func TestTTLRules(t *testing.T) {
+	defer setTTLs(0, nil)
+	setTTLs(time.Minute, []ttlRule{
+		{"/news/*", "", configDuration(time.Second)},
+		{"", "image/*", configDuration(time.Hour)},
+		{"/static/*", "text/*", 0},
+	})
+	expected := map[string]time.Duration{
+		"./news/today.html":  time.Second,
+		"./logo.png":         time.Hour,
+		"./static/style.css": 0,
+		"./static/logo.png":  time.Hour,
+		"./index.html":       time.Minute,
+	}
+	for filename, ttl := range expected {
+		if actual := fileTTL(filename); actual != ttl {
+			t.Errorf("Wrong TTL for (%s)! Expected: (%v), Actual: (%v)", filename, ttl, actual)
+		}
+	}
+	for _, rules := range [][]ttlRule{
+		{{"", "", configDuration(time.Second)}},
+		{{"news/*", "", configDuration(time.Second)}},
+		{{"/news/[", "", configDuration(time.Second)}},
+		{{"", "image/[", configDuration(time.Second)}},
+		{{"/news/*", "", configDuration(-time.Second)}},
+	} {
+		if err := validateTTLRules(rules); err == nil {
+			t.Errorf("Bad TTL rules were accepted! (%+v)", rules)
+		}
+	}
+}
+
+func TestTTLStaleIfError(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = ""
+	ttl := time.Millisecond * 50
+	setTTLs(ttl, nil)
+	staleIfError = time.Hour
+	defer func() {
+		setTTLs(0, nil)
+		staleIfError = 0
+		launchCache()
+	}()
+	launchCache()
+	version := "one"
+	// We set the userlib FileRead function to this custom 'read'.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		if version == "" {
+			return nil, errors.New("disk failure")
+		}
+		data = []byte(fmt.Sprintf("FID:%v:%v", filename[2:], version))
+		return
+	})
+	if resp := requestFile("/a.html", secTimeout, t); string(resp.data) != "FID:a.html:one" {
+		t.Errorf("Got the wrong file! Actual: (%s)", resp.data)
+	}
+	time.Sleep(ttl)
+	version = ""
+	resp := requestFile("/a.html", secTimeout, t)
+	if resp.statusCode != userlib.SUCCESSCODE || string(resp.data) != "FID:a.html:one" {
+		t.Errorf("A failed read should serve the last good copy! Actual: (%v, %s)", resp.statusCode, resp.data)
+	}
+	if resp := requestFile("/b.html", secTimeout, t); resp.statusCode != userlib.FILEERRORCODE {
+		t.Errorf("A failed read without a cached copy should fail! Actual: (%v)", resp.statusCode)
+	}
+	time.Sleep(ttl)
+	version = "two"
+	if resp := requestFile("/a.html", secTimeout, t); string(resp.data) != "FID:a.html:two" {
+		t.Errorf("An expired file was not read again! Actual: (%s)", resp.data)
+	}
+	if stats := fileCache.Stats(); stats.StaleHits != 1 || stats.FileErrors != 2 {
+		t.Errorf("Wrong stats! Expected: (1 stale hit, 2 file errors), Actual: (%v, %v)", stats.StaleHits, stats.FileErrors)
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+// ============ End of TTL Tests ============
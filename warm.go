@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * Cache warm-up at startup (-warm): the files listed by a manifest, a glob or a previous
+ * access log are read into the cache through the normal miss path, warmConcurrency at a
+ * time. With warmWait, /ready answers 503 until it is done.
+ */
+var (
+	warmSource      string
+	warmConcurrency = 8
+	warmWait        bool
+)
+
+/**
+ * The progress of the warm-up, shown on /cache/stats.json. Skipped files are missing, or
+ * don't fit in the cache (or are streamed) once the files before them are in.
+ */
+type warmProgress struct {
+	mutex   sync.Mutex
+	done    chan bool // Closed once the warm-up is over.
+	started time.Time
+	status  warmStatus
+}
+
+type warmStatus struct {
+	Running bool    `json:"running"`
+	Total   int     `json:"total"`
+	Loaded  int     `json:"loaded"`
+	Failed  int     `json:"failed"`
+	Skipped int     `json:"skipped"`
+	Bytes   int64   `json:"bytes"`
+	Seconds float64 `json:"seconds"`
+}
+
+/**
+ * The warm-up of this server, nil without -warm.
+ */
+var warmup *warmProgress
+
+func (p *warmProgress) snapshot() warmStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	status := p.status
+	if status.Running {
+		status.Seconds = time.Now().Sub(p.started).Seconds()
+	}
+	return status
+}
+
+func (p *warmProgress) finished() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+/**
+ * The files to warm up, by decreasing priority. A source that names a file is read as a
+ * previous access log (combined or json, the most requested files first) or as a manifest
+ * (one path or glob per line, in order), anything else is a glob under the working dir.
+ */
+func warmList(source string) ([]string, error) {
+	if info, err := os.Stat(source); err == nil && info.Mode().IsRegular() {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return readWarmManifest(file)
+	}
+	if !strings.ContainsAny(source, "*?[") {
+		return nil, fmt.Errorf("warm: '%s' is neither a file nor a glob", source)
+	}
+	return globFiles(source)
+}
+
+/**
+ * Reads a manifest, or an access log (told apart by their first line).
+ */
+func readWarmManifest(file *os.File) ([]string, error) {
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var names []string
+	counts := make(map[string]int)
+	accessLog, detected := false, false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !detected {
+			_, _, accessLog = parseAccessLine(line)
+			detected = true
+		}
+		if accessLog {
+			uri, status, ok := parseAccessLine(line)
+			if !ok || status >= http.StatusBadRequest {
+				continue
+			}
+			if name, err := resolveFilename(strings.SplitN(uri, "?", 2)[0]); err == nil {
+				if counts[name] == 0 {
+					names = append(names, name)
+				}
+				counts[name]++
+			}
+		} else if strings.ContainsAny(line, "*?[") {
+			matches, err := globFiles(line)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, matches...)
+		} else if name, err := resolveFilename(line); err == nil {
+			names = append(names, name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if accessLog {
+		sort.SliceStable(names, func(i, j int) bool {
+			return counts[names[i]] > counts[names[j]]
+		})
+	}
+	return dedupNames(names), nil
+}
+
+/**
+ * The request URI and status of an access log line (see formatCombined and accessEntry),
+ * ok is false if it is not one. Only GET and HEAD requests count.
+ */
+func parseAccessLine(line string) (uri string, status int, ok bool) {
+	var entry accessEntry
+	var method string
+	if strings.HasPrefix(line, "{") {
+		if json.Unmarshal([]byte(line), &entry) != nil || entry.URI == "" {
+			return "", 0, false
+		}
+		method, uri, status = entry.Method, entry.URI, entry.Status
+	} else {
+		start := strings.IndexByte(line, '"')
+		if start < 0 {
+			return "", 0, false
+		}
+		quoted, err := strconv.QuotedPrefix(line[start:])
+		if err != nil {
+			return "", 0, false
+		}
+		request, _ := strconv.Unquote(quoted)
+		fields := strings.Fields(line[start+len(quoted):])
+		parts := strings.Fields(request)
+		if len(fields) == 0 || len(parts) < 2 {
+			return "", 0, false
+		}
+		if status, err = strconv.Atoi(fields[0]); err != nil {
+			return "", 0, false
+		}
+		method, uri = parts[0], parts[1]
+	}
+	return uri, status, method == http.MethodGet || method == http.MethodHead
+}
+
+/**
+ * The files (not directories) under the working dir that match a glob (see
+ * filepath.Match) rooted at the working dir, in lexical order.
+ */
+func globFiles(pattern string) ([]string, error) {
+	root := workingDir
+	if root == "" {
+		root = "."
+	}
+	matches, err := filepath.Glob(filepath.Join(root, filepath.FromSlash(strings.TrimPrefix(pattern, "/"))))
+	if err != nil {
+		return nil, fmt.Errorf("warm: bad glob '%s': %v", pattern, err)
+	}
+	var names []string
+	for _, match := range matches {
+		if info, err := os.Stat(match); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		rel, err := filepath.Rel(root, match)
+		if err != nil {
+			continue
+		}
+		escaped := (&url.URL{Path: "/" + filepath.ToSlash(rel)}).EscapedPath()
+		if name, err := resolveFilename(escaped); err == nil {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func dedupNames(names []string) []string {
+	seen := make(map[string]bool)
+	unique := []string{}
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+/**
+ * Starts warming up the cache with the files (by decreasing priority). Only the files that
+ * fit in the capacity together are loaded, the others are skipped. They are handed to the
+ * workers from the lowest priority up, so the eviction policy sees the top of the list last
+ * (e.g. it is the last to go with lru or clock when the cache overflows). With several
+ * workers, files next to each other in the list may finish in either order.
+ */
+func startWarmup(names []string) *warmProgress {
+	progress := &warmProgress{done: make(chan bool), started: time.Now()}
+	progress.status.Running = true
+	var plan []string
+	room := int64(fileCache.Capacity())
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(workingDir, filepath.FromSlash(name)))
+		if err != nil || !info.Mode().IsRegular() || info.Size() > room || isStreamed(info.Size()) {
+			progress.status.Skipped++
+			continue
+		}
+		room -= info.Size()
+		plan = append(plan, name)
+	}
+	progress.status.Total = len(plan)
+	debugLog(fmt.Sprintf("Warming up the cache with %v files (%v skipped)", len(plan), progress.status.Skipped))
+
+	queue := make(chan string)
+	var workers sync.WaitGroup
+	for i := 0; i < warmConcurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for name := range queue {
+				file, err := fetchFile(context.Background(), name)
+				progress.mutex.Lock()
+				if err != nil {
+					progress.status.Failed++
+					debugLog(fmt.Sprintf("Could not warm up '%v': %v", name, err))
+				} else {
+					progress.status.Loaded++
+					progress.status.Bytes += int64(len(file.Data))
+				}
+				progress.mutex.Unlock()
+				file.Release()
+			}
+		}()
+	}
+	go func() {
+		for i := len(plan) - 1; i >= 0; i-- {
+			queue <- plan[i]
+		}
+		close(queue)
+		workers.Wait()
+		progress.mutex.Lock()
+		progress.status.Running = false
+		progress.status.Seconds = time.Now().Sub(progress.started).Seconds()
+		progress.mutex.Unlock()
+		close(progress.done)
+		debugLog(fmt.Sprintf("Warmed up the cache: %+v", progress.snapshot()))
+	}()
+	return progress
+}
+
+/**
+ * The handler for readiness checks: 503 while the warm-up runs with -warm-wait, 200 otherwise.
+ */
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if progress := warmup; progress != nil && warmWait && !progress.finished() {
+		status := progress.snapshot()
+		http.Error(w, fmt.Sprintf("warming up (%v of %v files)", status.Loaded+status.Failed, status.Total),
+			http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set(userlib.ContextType, "text/plain; charset=utf-8")
+	w.WriteHeader(userlib.SUCCESSCODE)
+	_, _ = w.Write([]byte("ready\n"))
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func validateWarmList(source string, expected []string, t *testing.T) (failed bool) {
+	names, err := warmList(source)
+	if err != nil || !reflect.DeepEqual(names, expected) {
+		failed = true
+		t.Errorf("Wrong warm-up list for (%s)! Expected: (%v), Actual: (%v, %v)", source, expected, names, err)
+	}
+	return failed
+}
+
+func requestWarmStatus(t *testing.T) *warmStatus {
+	resp := genResponseTestWriter()
+	cacheStatsHandler(resp, genRequestRawUrl("/cache/stats.json"))
+	var report struct {
+		Warmup *warmStatus `json:"warmup"`
+	}
+	if err := json.Unmarshal(resp.data, &report); err != nil || report.Warmup == nil {
+		t.Fatalf("Could not find the warm-up in the cache stats (%s): %v", string(resp.data), err)
+	}
+	return report.Warmup
+}
+
+// ============ Warm-up Tests ============
+
+func TestWarmSources(t *testing.T) {
+	workingDir = t.TempDir() + "/"
+	defer func() {
+		workingDir = ""
+	}()
+	for _, name := range []string{"a.txt", "b.txt", "css/x.css", "css/y.css"} {
+		if err := os.MkdirAll(filepath.Dir(workingDir+name), 0700); err != nil {
+			t.Fatal(err)
+		}
+		writeLargeFile(workingDir, name, 10, t)
+	}
+	dir := t.TempDir()
+
+	// A manifest keeps its order, globs are expanded in place.
+	manifest := writeConfig(dir, "manifest.txt", "# Deploy manifest\n/b.txt\n\n/css/*.css\n/a.txt\n/b.txt\n/%6Dissing.txt\n", t)
+	validateWarmList(manifest, []string{"./b.txt", "./css/x.css", "./css/y.css", "./a.txt", "./missing.txt"}, t)
+	validateWarmList("/css/*.css", []string{"./css/x.css", "./css/y.css"}, t)
+
+	// Access logs are ordered by the number of successful GET (or HEAD) requests.
+	entries := []accessEntry{
+		{Method: "GET", URI: "/a.txt", Status: 200},
+		{Method: "GET", URI: "/css/x.css", Status: 404},
+		{Method: "HEAD", URI: "/css/y.css?v=2", Status: 304},
+		{Method: "POST", URI: "/a.txt", Status: 405},
+		{Method: "POST", URI: "/a.txt", Status: 200},
+		{Method: "GET", URI: "/b.txt", Status: 200},
+		{Method: "GET", URI: "/css/y.css", Status: 200},
+		{Method: "GET", URI: "/b.txt", Status: 206},
+		{Method: "GET", URI: "/b.txt", Status: 200},
+	}
+	var combined, jsonLines strings.Builder
+	for i := range entries {
+		entries[i].Proto = "HTTP/1.1"
+		entries[i].Time = time.Now()
+		combined.WriteString(formatCombined(&entries[i]))
+		line, _ := json.Marshal(&entries[i])
+		jsonLines.WriteString(string(line) + "\n")
+	}
+	expected := []string{"./b.txt", "./css/y.css", "./a.txt"}
+	validateWarmList(writeConfig(dir, "access.log", combined.String(), t), expected, t)
+	validateWarmList(writeConfig(dir, "access.json", jsonLines.String(), t), expected, t)
+
+	if _, err := warmList(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Errorf("A source that is neither a file nor a glob was accepted!")
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 250
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = t.TempDir() + "/"
+	warmWait = true
+	defer func() {
+		workingDir = ""
+		warmWait = false
+		warmup = nil
+	}()
+	launchCache()
+	reads := uint64(0)
+	gate := make(chan bool)
+	// We set the userlib FileRead function to this custom 'read', which waits on the gate.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		<-gate
+		atomic.AddUint64(&reads, 1)
+		return ioutil.ReadFile(workingDir + filename)
+	})
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		writeLargeFile(workingDir, name, 100, t)
+	}
+
+	// "c.txt" no longer fits once the files before it are in.
+	warmup = startWarmup([]string{"./a.txt", "./b.txt", "./missing.txt", "./c.txt"})
+	if resp := requestMethod(http.MethodGet, "/ready"); resp.statusCode != http.StatusServiceUnavailable {
+		t.Errorf("The server should not be ready during the warm-up! Status: (%v)", resp.statusCode)
+	}
+	if status := requestWarmStatus(t); !status.Running || status.Total != 2 || status.Skipped != 2 || status.Loaded != 0 {
+		t.Errorf("Wrong warm-up progress! Actual: (%+v)", *status)
+	}
+	close(gate)
+	select {
+	case <-warmup.done:
+	case <-time.After(time.Duration(secTimeout+1) * time.Second):
+		t.Fatalf("The warm-up took too long!")
+	}
+	if resp := requestMethod(http.MethodGet, "/ready"); resp.statusCode != userlib.SUCCESSCODE {
+		t.Errorf("The server should be ready after the warm-up! Status: (%v)", resp.statusCode)
+	}
+	if status := requestWarmStatus(t); status.Running || status.Loaded != 2 || status.Failed != 0 || status.Bytes != 200 {
+		t.Errorf("Wrong warm-up progress! Actual: (%+v)", *status)
+	}
+	for _, name := range []string{"/a.txt", "/b.txt"} {
+		if resp := requestFile(name, secTimeout, t); resp.header.Get("Content-Length") != "100" {
+			t.Errorf("Could not get the warm file (%s)!", name)
+		}
+	}
+	if reads != 2 {
+		t.Errorf("The warm files should have been hits! Actual reads: (%v)", reads)
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestWarmupEvictionOrder(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 250
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = t.TempDir() + "/"
+	warmConcurrency = 1 // One file at a time, so the order is exact.
+	defer func() {
+		workingDir = ""
+		warmConcurrency = 8
+		warmup = nil
+	}()
+	names := []string{"./a.txt", "./b.txt", "./c.txt", "./d.txt"}
+	for _, name := range names {
+		writeLargeFile(workingDir, name[2:], 10, t)
+	}
+	// We set the userlib FileRead function to this custom 'read'. The files grew since the
+	// warm-up planned them, so they no longer fit together.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		return make([]byte, 100), nil
+	})
+	for _, policy := range []string{"lru", "clock"} {
+		evictionPolicy = policy
+		launchCache()
+		evictionPolicy = "random" // Only the cache we just launched should use it.
+		warmup = startWarmup(names)
+		select {
+		case <-warmup.done:
+		case <-time.After(time.Duration(secTimeout+1) * time.Second):
+			t.Fatalf("The warm-up took too long!")
+		}
+		// The top of the list is the last to go.
+		for i, name := range names {
+			file := fileCache.GetCached(name)
+			if (file != nil) != (i < 2) {
+				t.Errorf("Wrong file left by the warm-up with %s for (%s)! Cached: (%v)", policy, name, file != nil)
+			}
+			file.Release()
+		}
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+// ============ End of Warm-up Tests ============
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server/cache"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_ONLYDIR
+
+/**
+ * Watches the working dir (recursively) with inotify and invalidates cached files
+ * when they are modified, renamed or deleted on disk.
+ */
+type watcher struct {
+	root    string
+	cache   *cache.Cache
+	inotify *os.File       // Non-blocking fd, so closing it stops the event loop.
+	watches map[int]string // Watch descriptor -> watched directory. Only used by run.
+}
+
+/**
+ * Starts watching every directory under root (the dir that c reads from). New directories
+ * get watched as they show up.
+ */
+func startWatcher(root string, c *cache.Cache) (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("could not start inotify: %v", err)
+	}
+	w := &watcher{filepath.Clean(root), c, os.NewFile(uintptr(fd), "inotify"), make(map[int]string)}
+	if err := w.addWatches(w.root); err != nil {
+		_ = w.inotify.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *watcher) Close() error {
+	return w.inotify.Close()
+}
+
+/**
+ * Adds a watch for dir and every directory below it.
+ */
+func (w *watcher) addWatches(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil // It was removed while walking, the delete event handles it.
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(int(w.inotify.Fd()), path, watchMask)
+		if err != nil {
+			return fmt.Errorf("could not watch '%s': %v", path, err)
+		}
+		w.watches[wd] = path
+		return nil
+	})
+}
+
+/**
+ * Cache key (the filename handed out by getFile) for a path under the root.
+ */
+func (w *watcher) cacheKey(path string) string {
+	rel, err := filepath.Rel(w.root, path)
+	if err != nil || rel == "." {
+		return "./"
+	}
+	return "./" + filepath.ToSlash(rel)
+}
+
+func (w *watcher) run() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.inotify.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				log.Printf("Stopped watching '%s': %v", w.root, err)
+			}
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+			offset = nameStart + int(event.Len)
+			w.handleEvent(int(event.Wd), event.Mask, name)
+		}
+	}
+}
+
+func (w *watcher) handleEvent(wd int, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		debugLog("\t[W] Inotify queue overflowed, invalidating everything")
+		w.cache.InvalidatePrefix("./")
+		return
+	}
+	dir, ok := w.watches[wd]
+	if !ok {
+		return
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.watches, wd) // The directory is gone (or was unmounted).
+		return
+	}
+	if name == "" {
+		return // Event on the watched directory itself, its parent reports it.
+	}
+	path := filepath.Join(dir, name)
+	key := w.cacheKey(path)
+	if mask&syscall.IN_ISDIR != 0 {
+		if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+			if err := w.addWatches(path); err != nil {
+				log.Println(err)
+			}
+		}
+		debugLog(fmt.Sprintf("\t[W] Directory changed: %v", key))
+		w.cache.InvalidatePrefix(key + "/")
+		return
+	}
+	debugLog(fmt.Sprintf("\t[W] File changed: %v", key))
+	w.cache.Invalidate(key)
+	if base, ok := precompressedBase(key); ok {
+		w.cache.Invalidate(base) // Along with its variants, one of them came from this file.
+	}
+}
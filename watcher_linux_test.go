@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server-Userlib"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+ *	Keeps requesting the file until the expected data comes back (the watcher is asynchronous).
+ */
+func waitForFileData(name string, expected []byte, secTimeout int, t *testing.T) (failed bool) {
+	deadline := time.Now().Add(time.Duration(secTimeout) * time.Second)
+	for {
+		resp := requestFile(name, secTimeout, t)
+		if bytes.Equal(resp.data, expected) {
+			return false
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("The cache never picked up the change! Expected (%s), Actual (%s)", string(expected), string(resp.data))
+			return true
+		}
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+}
+
+// ============ Watcher Tests ============
+
+func TestWatcherInvalidatesChangedFiles(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	dir, err := ioutil.TempDir("", "watcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	workingDir = dir + "/"
+	launchCache()
+	// We set the userlib FileRead function to read from the temp dir.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		return ioutil.ReadFile(workingDir + filename)
+	})
+	w, err := startWatcher(workingDir, fileCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	name := "/index.html"
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("version 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	resp := requestFile(name, secTimeout, t)
+	validateFileResponse("."+name, "."+name, []byte("version 1"), resp, userlib.SUCCESSCODE, t)
+	// Modified in place.
+	if err := ioutil.WriteFile(path, []byte("version 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForFileData(name, []byte("version 2"), secTimeout, t)
+	// Replaced through a rename (like most deploy tools do).
+	if err := ioutil.WriteFile(path+".tmp", []byte("version 3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+	waitForFileData(name, []byte("version 3"), secTimeout, t)
+	// Deleted.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	waitForFileData(name, []byte(userlib.FILEERRORMSG+"\n"), secTimeout, t)
+	validateCacheSize(0, 0, t)
+	workingDir = ""
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestWatcherInvalidatesPrecompressedVariants(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = t.TempDir() + "/"
+	defer func() {
+		workingDir = ""
+	}()
+	launchCache()
+	// We set the userlib FileRead function to read from the temp dir.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		return ioutil.ReadFile(workingDir + filename)
+	})
+	name := "/style.css"
+	for file, content := range map[string]string{name: "plain", name + ".gz": "gzip 1"} {
+		if err := ioutil.WriteFile(workingDir+file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := startWatcher(workingDir, fileCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	requestGzip := func() []byte {
+		resp := genResponseTestWriter()
+		handler(resp, genConditionalRequest(name, "Accept-Encoding", "gzip"))
+		return resp.data
+	}
+	if data := requestGzip(); string(data) != "gzip 1" {
+		t.Fatalf("Could not get the precompressed sibling! Actual: (%s)", data)
+	}
+	// Only the sibling changes, the variant of the file cached from it must go.
+	if err := ioutil.WriteFile(workingDir+name+".gz", []byte("gzip 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Duration(secTimeout) * time.Second); ; {
+		data := requestGzip()
+		if string(data) == "gzip 2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("The cache never picked up the changed sibling! Actual: (%s)", data)
+			break
+		}
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestWatcherWatchesNewDirectories(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	dir, err := ioutil.TempDir("", "watcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	workingDir = dir + "/"
+	launchCache()
+	// We set the userlib FileRead function to read from the temp dir.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		return ioutil.ReadFile(workingDir + filename)
+	})
+	w, err := startWatcher(workingDir, fileCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	// The directory is created after the watcher started.
+	if err := os.MkdirAll(filepath.Join(dir, "resume", "css"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Duration(100) * time.Millisecond) // Let the watcher add the new directories.
+	name := "/resume/css/style.css"
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("body {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForFileData(name, []byte("body {}"), secTimeout, t)
+	if err := ioutil.WriteFile(path, []byte("body { color: blue; }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForFileData(name, []byte("body { color: blue; }"), secTimeout, t)
+	// Removing the whole directory drops everything under it.
+	if err := os.RemoveAll(filepath.Join(dir, "resume")); err != nil {
+		t.Fatal(err)
+	}
+	waitForFileData(name, []byte(userlib.FILEERRORMSG+"\n"), secTimeout, t)
+	validateCacheSize(0, 0, t)
+	workingDir = ""
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+func TestWatcherChangeDuringRead(t *testing.T) {
+	// We first need to define a capacity and timeout so our cache has some parameters.
+	secCap := 1000
+	secTimeout := 2
+	capacity = secCap
+	timeout = secTimeout
+	workingDir = t.TempDir() + "/"
+	defer func() {
+		workingDir = ""
+	}()
+	launchCache()
+	name := "/index.html"
+	path := filepath.Join(workingDir, name)
+	if err := ioutil.WriteFile(path, []byte("version 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reading := make(chan bool, 1)
+	gate := make(chan bool)
+	// We set the userlib FileRead function to this custom 'read', which reads the file and
+	// then waits on the gate before handing the data back.
+	userlib.ReplaceReadFile(func(workingDir, filename string) (data []byte, err error) {
+		data, err = ioutil.ReadFile(workingDir + filename)
+		select {
+		case reading <- true:
+			<-gate
+		default:
+		}
+		return
+	})
+	w, err := startWatcher(workingDir, fileCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	done := make(chan *ResponseWriterTester)
+	go func() {
+		done <- requestFile(name, secTimeout, t)
+	}()
+	<-reading
+	// The file changes while its old content is on the way into the cache.
+	if err := ioutil.WriteFile(path, []byte("version 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Duration(100) * time.Millisecond) // Let the watcher invalidate it.
+	close(gate)
+	validateFileResponse("."+name, "."+name, []byte("version 1"), <-done, userlib.SUCCESSCODE, t)
+	// The old content was not cached, the next request reads the new one.
+	resp := requestFile(name, secTimeout, t)
+	validateFileResponse("."+name, "."+name, []byte("version 2"), resp, userlib.SUCCESSCODE, t)
+	if capacity != secCap {
+		t.Errorf("The max capacity has been changed when it should not have been!")
+		os.Exit(61)
+	}
+	if timeout != secTimeout {
+		t.Errorf("The timeout has been changed when it should not have been!")
+		os.Exit(62)
+	}
+	clearCache()
+}
+
+// ============ End of Watcher Tests ============
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"github.com/Daniel-VDM/Concurrent-Cached-File-Server/cache"
+)
+
+/**
+ * File watching relies on inotify, so it is only supported on Linux.
+ */
+type watcher struct{}
+
+func startWatcher(root string, c *cache.Cache) (*watcher, error) {
+	return nil, fmt.Errorf("watching '%s' for changes is only supported on linux", root)
+}
+
+func (w *watcher) Close() error {
+	return nil
+}